@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/log"
+)
+
+// the ways of logging in to couch
+const (
+	authBasic   = "basic"
+	authSession = "session"
+	authProxy   = "proxy"
+	authBearer  = "bearer"
+)
+
+// authenticator adds credentials to requests sent to couch.
+type authenticator interface {
+	// authorize adds credentials to req.
+	authorize(req *http.Request) error
+
+	// observe sees every response, in case it carries new credentials.
+	observe(resp *http.Response)
+
+	// refresh is called when couch rejects the credentials, and is true if they were renewed and the request should be sent again.
+	refresh() bool
+}
+
+// newAuthenticator returns the authenticator the options ask for.
+func newAuthenticator(o *options) (authenticator, error) {
+	password, err := secret(o.password, o.passwordFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read password : %v", err)
+	}
+
+	token, err := secret(o.token, o.tokenFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read token : %v", err)
+	}
+
+	switch o.auth {
+	case authBasic:
+		return basicAuth{username: o.username, password: password}, nil
+	case authSession:
+		if len(o.username) == 0 || len(password) == 0 {
+			return nil, fmt.Errorf("session auth needs a username and password")
+		}
+
+		return &sessionAuth{address: o.address, username: o.username, password: password, client: couchClient(o.transport), timeout: o.timeout}, nil
+	case authProxy:
+		if len(o.username) == 0 {
+			return nil, fmt.Errorf("proxy auth needs a username")
+		}
+
+		return proxyAuth{username: o.username, roles: o.proxyRoles, token: token}, nil
+	case authBearer:
+		if len(token) == 0 {
+			return nil, fmt.Errorf("bearer auth needs a token")
+		}
+
+		return bearerAuth{token: token}, nil
+	default:
+		return nil, fmt.Errorf("unknown auth %q (must be basic, session, proxy or bearer)", o.auth)
+	}
+}
+
+// couchAuth returns the authenticator for o, exiting if its credentials can't be loaded.
+func (o *options) couchAuth() authenticator {
+	auth, err := newAuthenticator(o)
+	if err != nil {
+		log.L.Fatalf("Invalid couch credentials : %v", err)
+	}
+
+	return auth
+}
+
+// secret is value, or the contents of file if it is set, so secrets don't have to be
+// in the environment or on the command line.
+func secret(value, file string) (string, error) {
+	if len(file) == 0 {
+		return value, nil
+	}
+
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
+
+// basicAuth sends the username and password with every request.
+type basicAuth struct {
+	username string
+	password string
+}
+
+func (a basicAuth) authorize(req *http.Request) error {
+	if len(a.username) > 0 && len(a.password) > 0 {
+		req.SetBasicAuth(a.username, a.password)
+	}
+
+	return nil
+}
+
+func (basicAuth) observe(*http.Response) {}
+
+func (basicAuth) refresh() bool {
+	return false
+}
+
+// sessionAuth logs in through _session once, and sends the cookie it gets back with every request.
+// It logs in again if couch stops accepting the cookie.
+type sessionAuth struct {
+	address  string
+	username string
+	password string
+
+	client  *http.Client
+	timeout time.Duration
+
+	mu     sync.Mutex
+	cookie *http.Cookie
+}
+
+const sessionCookie = "AuthSession"
+
+func (a *sessionAuth) authorize(req *http.Request) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.cookie == nil {
+		if err := a.login(); err != nil {
+			return err
+		}
+	}
+
+	req.AddCookie(a.cookie)
+	return nil
+}
+
+// observe keeps the refreshed cookie couch sends back as a session nears its end.
+func (a *sessionAuth) observe(resp *http.Response) {
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie && len(c.Value) > 0 {
+			a.mu.Lock()
+			a.cookie = c
+			a.mu.Unlock()
+		}
+	}
+}
+
+func (a *sessionAuth) refresh() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if err := a.login(); err != nil {
+		// the request that was rejected fails, and is reported with the rest
+		log.L.Errorf("Failed to log in to couch again : %v", err)
+		return false
+	}
+
+	return true
+}
+
+// login must be called with a.mu held.
+func (a *sessionAuth) login() error {
+	body, err := json.Marshal(map[string]string{"name": a.username, "password": a.password})
+	if err != nil {
+		return fmt.Errorf("cannot marshal login : %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest("POST", fmt.Sprintf("%v/_session", a.address), bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error making request : %v", err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error logging in : %v", err)
+	}
+	defer resp.Body.Close()
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("unable to read response : %v", err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		ce := parseCouchError(b)
+		return fmt.Errorf("unable to log in as %v : %v (%v)", a.username, ce.Error, ce.Reason)
+	}
+
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookie {
+			a.cookie = c
+			return nil
+		}
+	}
+
+	return fmt.Errorf("couch didn't send back a session cookie")
+}
+
+// proxyAuth sends the headers couch's proxy authentication expects from a trusted proxy.
+type proxyAuth struct {
+	username string
+	roles    string // comma separated
+	token    string // hex HMAC of the username with couch's proxy secret, if couch requires it
+}
+
+func (a proxyAuth) authorize(req *http.Request) error {
+	req.Header.Set("X-Auth-CouchDB-UserName", a.username)
+	if len(a.roles) > 0 {
+		req.Header.Set("X-Auth-CouchDB-Roles", a.roles)
+	}
+	if len(a.token) > 0 {
+		req.Header.Set("X-Auth-CouchDB-Token", a.token)
+	}
+
+	return nil
+}
+
+func (proxyAuth) observe(*http.Response) {}
+
+func (proxyAuth) refresh() bool {
+	return false
+}
+
+// bearerAuth sends a bearer token (a JWT, for couch) with every request.
+type bearerAuth struct {
+	token string
+}
+
+func (a bearerAuth) authorize(req *http.Request) error {
+	req.Header.Set("Authorization", "Bearer "+a.token)
+	return nil
+}
+
+func (bearerAuth) observe(*http.Response) {}
+
+func (bearerAuth) refresh() bool {
+	return false
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionCouch hands out a new session cookie for every login, and only accepts the latest one
+// (or none at all, once it is told to reject everything).
+type sessionCouch struct {
+	mu       sync.Mutex
+	logins   int
+	requests int
+	valid    string
+	reject   bool
+}
+
+func (s *sessionCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if r.URL.Path == "/_session" && r.Method == "POST" {
+		s.logins++
+		s.valid = fmt.Sprintf("session-%v", s.logins)
+
+		http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: s.valid})
+		w.Write([]byte(`{"ok":true}`))
+		return
+	}
+
+	s.requests++
+
+	c, err := r.Cookie(sessionCookie)
+	if s.reject || err != nil || c.Value != s.valid {
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"unauthorized","reason":"You are not authorized to access this db."}`))
+		return
+	}
+
+	w.Write([]byte(`{"_id":"ITB","_rev":"1-a"}`))
+}
+
+// expire makes couch forget the current session.
+func (s *sessionCouch) expire() {
+	s.mu.Lock()
+	s.valid = ""
+	s.mu.Unlock()
+}
+
+func (s *sessionCouch) counts() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.logins, s.requests
+}
+
+func TestSessionAuth(t *testing.T) {
+	s := &sessionCouch{}
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	couch := testCouch(srv.URL, overwriteExisting)
+	couch.auth = &sessionAuth{address: srv.URL, username: "migration", password: "secret", client: http.DefaultClient, timeout: 5 * time.Second}
+
+	// logs in before the first request
+	if doc, err := couch.Get("buildings", "ITB"); err != nil || doc == nil {
+		t.Fatalf("Get = %v, %v, want buildings/ITB", doc, err)
+	}
+	if logins, requests := s.counts(); logins != 1 || requests != 1 {
+		t.Errorf("%v logins and %v requests, want 1 and 1", logins, requests)
+	}
+
+	// the session runs out, so the rejected request logs in again and is sent once more
+	s.expire()
+	if doc, err := couch.Get("buildings", "ITB"); err != nil || doc == nil {
+		t.Fatalf("Get after the session expired = %v, %v, want buildings/ITB", doc, err)
+	}
+	if logins, requests := s.counts(); logins != 2 || requests != 3 {
+		t.Errorf("%v logins and %v requests, want 2 and 3", logins, requests)
+	}
+
+	// credentials that are never accepted log in once more and give up, instead of looping
+	s.mu.Lock()
+	s.reject = true
+	s.mu.Unlock()
+
+	if _, err := couch.Get("buildings", "ITB"); err == nil {
+		t.Errorf("Get while couch rejects everything succeeded")
+	}
+	if logins, requests := s.counts(); logins != 3 || requests != 5 {
+		t.Errorf("%v logins and %v requests, want 3 and 5", logins, requests)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+
+	"github.com/byuoitav/common/log"
+)
+
+// bulkSink buffers documents per database and writes them to couch through _bulk_docs,
+// size documents at a time.
+type bulkSink struct {
+	couch  *couchSink
+	size   int
+	report *Report
+
+	// mu guards pending and writing, it isn't held while a batch is written
+	mu      sync.Mutex
+	pending map[string][]Document
+
+	// writing is every document (db/id) in a batch being written, so the same document is never in two batches at once
+	writing map[string]bool
+	done    *sync.Cond
+}
+
+func newBulkSink(couch *couchSink, size int, report *Report) *bulkSink {
+	b := &bulkSink{
+		couch:   couch,
+		size:    size,
+		report:  report,
+		pending: make(map[string][]Document),
+		writing: make(map[string]bool),
+	}
+
+	b.done = sync.NewCond(&b.mu)
+	return b
+}
+
+func (b *bulkSink) Put(doc Document) []Result {
+	b.mu.Lock()
+
+	docs := b.pending[doc.DB]
+	var batch []Document
+
+	// a batch can't hold the same document twice, so the one already waiting goes out first
+	for _, d := range docs {
+		if d.ID == doc.ID {
+			b.report.Warnf("%v/%v was generated twice (%v, then %v), writing both", doc.DB, doc.ID, d.Origin, doc.Origin)
+			batch, docs = docs, nil
+			break
+		}
+	}
+
+	docs = append(docs, doc)
+	if batch == nil && len(docs) >= b.size {
+		batch, docs = docs, nil
+	}
+
+	if len(docs) > 0 {
+		b.pending[doc.DB] = docs
+	} else {
+		delete(b.pending, doc.DB)
+	}
+
+	if batch != nil {
+		b.claim(doc.DB, batch)
+	}
+
+	b.mu.Unlock()
+
+	if batch == nil {
+		return nil
+	}
+
+	return b.write(doc.DB, batch)
+}
+
+// Flush writes everything that is still buffered.
+func (b *bulkSink) Flush() []Result {
+	b.mu.Lock()
+
+	var dbs []string
+	for db := range b.pending {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+
+	batches := make(map[string][]Document)
+	for _, db := range dbs {
+		batches[db] = b.pending[db]
+		delete(b.pending, db)
+
+		b.claim(db, batches[db])
+	}
+
+	b.mu.Unlock()
+
+	var results []Result
+	for _, db := range dbs {
+		results = append(results, b.write(db, batches[db])...)
+	}
+
+	return results
+}
+
+// claim marks batch as being written, first waiting for any batch already being written with one of
+// the same documents to finish. b.mu must be held.
+func (b *bulkSink) claim(db string, batch []Document) {
+	for b.overlaps(db, batch) {
+		b.done.Wait()
+	}
+
+	for _, doc := range batch {
+		b.writing[db+"/"+doc.ID] = true
+	}
+}
+
+func (b *bulkSink) overlaps(db string, batch []Document) bool {
+	for _, doc := range batch {
+		if b.writing[db+"/"+doc.ID] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// write writes a claimed batch, then lets anything waiting for its documents go.
+func (b *bulkSink) write(db string, batch []Document) []Result {
+	results := b.couch.bulkWrite(db, batch)
+
+	b.mu.Lock()
+	for _, doc := range batch {
+		delete(b.writing, db+"/"+doc.ID)
+	}
+	b.mu.Unlock()
+
+	b.done.Broadcast()
+	return results
+}
+
+type allDocsResponse struct {
+	Rows []struct {
+		Key   string                 `json:"key"`
+		Error string                 `json:"error"`
+		Doc   map[string]interface{} `json:"doc"`
+	} `json:"rows"`
+}
+
+type bulkDocsResponse []struct {
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// bulkWrite writes docs (all of which must belong to db) in a single _bulk_docs request.
+func (c *couchSink) bulkWrite(db string, docs []Document) []Result {
+	log.L.Debugf("Writing %v documents to %v", len(docs), db)
+
+	existing, err := c.getAll(db, docs)
+	if err != nil {
+		return failAll(docs, 0, err.Error(), "")
+	}
+
+	var results []Result
+	var toWrite []Document
+	var actions []string
+	var bodies []map[string]interface{}
+	var previous []map[string]interface{}
+
+	for _, doc := range docs {
+		have := existing[doc.ID]
+
+		action, err := decide(c.policy, doc, have)
+		if err != nil {
+			results = append(results, doc.failed(err))
+			continue
+		}
+		if action != actionCreated && action != actionUpdated {
+			results = append(results, doc.result(action))
+			continue
+		}
+
+		m, err := toMap(doc.Body)
+		if err != nil {
+			results = append(results, doc.failed(fmt.Errorf("cannot marshal %v/%v : %v", doc.DB, doc.ID, err)))
+			continue
+		}
+
+		m["_id"] = doc.ID
+		if have != nil {
+			m["_rev"] = have["_rev"]
+		}
+
+		toWrite = append(toWrite, doc)
+		actions = append(actions, action)
+		bodies = append(bodies, m)
+		previous = append(previous, have)
+	}
+
+	if len(toWrite) == 0 {
+		return results
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"docs": bodies})
+	if err != nil {
+		return append(results, failAll(toWrite, 0, fmt.Sprintf("cannot marshal bulk request : %v", err), "")...)
+	}
+
+	status, b, attempts, err := c.send("POST", fmt.Sprintf("%v/_bulk_docs", db), body)
+	if err != nil {
+		return append(results, failAll(toWrite, 0, err.Error(), "")...)
+	}
+
+	if status/100 != 2 {
+		ce := parseCouchError(b)
+		return append(results, failAll(toWrite, status, ce.Error, ce.Reason)...)
+	}
+
+	var resp bulkDocsResponse
+	if err := json.Unmarshal(b, &resp); err != nil || len(resp) != len(toWrite) {
+		return append(results, failAll(toWrite, status, fmt.Sprintf("unexpected bulk response : %s", b), "")...)
+	}
+
+	// documents that conflicted after a retry may have been written by the attempt whose response was lost
+	var current map[string]map[string]interface{}
+	if attempts > 1 {
+		var conflicted []Document
+		for i, doc := range toWrite {
+			if resp[i].Error == "conflict" {
+				conflicted = append(conflicted, doc)
+			}
+		}
+
+		if len(conflicted) > 0 {
+			current, err = c.getAll(db, conflicted)
+			if err != nil {
+				log.L.Warnf("Unable to check whether %v conflicting documents were already written : %v", len(conflicted), err)
+			}
+		}
+	}
+
+	// couch answers in the same order the documents were sent
+	for i, doc := range toWrite {
+		res := doc.result(actions[i])
+		res.Status = status
+		res.Rev = resp[i].Rev
+		res.Previous = previous[i]
+
+		if resp[i].Error == "conflict" && landed(doc, current[doc.ID]) {
+			res.Rev, _ = current[doc.ID]["_rev"].(string)
+		} else if len(resp[i].Error) > 0 {
+			res.Action = actionFailed
+			res.Status = bulkErrorStatus(resp[i].Error)
+			res.Error = resp[i].Error
+			res.Reason = resp[i].Reason
+		}
+
+		results = append(results, res)
+	}
+
+	return results
+}
+
+// failAll marks every one of docs as failed with the same error.
+func failAll(docs []Document, status int, err, reason string) []Result {
+	results := make([]Result, len(docs))
+	for i := range docs {
+		results[i] = docs[i].result(actionFailed)
+		results[i].Status = status
+		results[i].Error = err
+		results[i].Reason = reason
+	}
+
+	return results
+}
+
+// getAll fetches the current version of each of docs from db, keyed by id.
+// Documents that don't exist (or were deleted) are left out.
+func (c *couchSink) getAll(db string, docs []Document) (map[string]map[string]interface{}, error) {
+	keys := make([]string, len(docs))
+	for i := range docs {
+		keys[i] = docs[i].ID
+	}
+
+	body, err := json.Marshal(map[string]interface{}{"keys": keys})
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal keys : %v", err)
+	}
+
+	status, b, err := c.do("POST", fmt.Sprintf("%v/_all_docs?include_docs=true", db), body)
+	if err != nil {
+		return nil, err
+	}
+
+	if status/100 != 2 {
+		return nil, fmt.Errorf("unable to get existing documents from %v : %v %s", db, status, b)
+	}
+
+	var resp allDocsResponse
+	if err := json.Unmarshal(b, &resp); err != nil {
+		return nil, fmt.Errorf("unable to parse existing documents from %v : %v", db, err)
+	}
+
+	existing := make(map[string]map[string]interface{})
+	for _, row := range resp.Rows {
+		if len(row.Error) > 0 || row.Doc == nil {
+			continue
+		}
+
+		existing[row.Key] = row.Doc
+	}
+
+	return existing, nil
+}
+
+// bulkErrorStatus maps the per-document errors in a _bulk_docs response onto the status
+// couch would have returned had the document been written on its own.
+func bulkErrorStatus(err string) int {
+	switch err {
+	case "conflict":
+		return http.StatusConflict
+	case "forbidden":
+		return http.StatusForbidden
+	case "unauthorized":
+		return http.StatusUnauthorized
+	default:
+		return http.StatusInternalServerError
+	}
+}
@@ -0,0 +1,292 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type noAuth struct{}
+
+func (noAuth) authorize(req *http.Request) error { return nil }
+func (noAuth) observe(resp *http.Response)       {}
+func (noAuth) refresh() bool                     { return false }
+
+// testCouch is a couch sink for address that tries every request once.
+func testCouch(address string, policy existingPolicy) *couchSink {
+	return &couchSink{
+		ctx:     context.Background(),
+		address: address,
+		auth:    noAuth{},
+		policy:  policy,
+		client:  http.DefaultClient,
+		timeout: 5 * time.Second,
+		retry:   retryPolicy{attempts: 1},
+		breaker: newBreaker(0, 0),
+	}
+}
+
+// fakeCouch is just enough of couch to write documents to, keeping them in memory.
+type fakeCouch struct {
+	mu   sync.Mutex
+	dbs  map[string]map[string]map[string]interface{}
+	revs int
+
+	// reject fails the documents with these ids in _bulk_docs, with the error given
+	reject map[string]string
+
+	// indexes is the fields of every index installed, by db and name
+	indexes map[string]map[string][]string
+}
+
+func newFakeCouch(dbs ...string) *fakeCouch {
+	f := &fakeCouch{
+		dbs:     make(map[string]map[string]map[string]interface{}),
+		reject:  make(map[string]string),
+		indexes: make(map[string]map[string][]string),
+	}
+
+	for _, db := range dbs {
+		f.dbs[db] = make(map[string]map[string]interface{})
+	}
+
+	return f
+}
+
+// doc returns db/id as it is stored, or nil.
+func (f *fakeCouch) doc(db, id string) map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.dbs[db][id]
+}
+
+// write stores doc as id in db, if its _rev matches the one stored. f.mu must be held.
+func (f *fakeCouch) write(db, id string, doc map[string]interface{}) (string, bool) {
+	have, ok := f.dbs[db][id]
+	if ok && have["_rev"] != doc["_rev"] || !ok && doc["_rev"] != nil {
+		return "", false
+	}
+
+	f.revs++
+	rev := fmt.Sprintf("%d-fake", f.revs)
+
+	doc["_id"], doc["_rev"] = id, rev
+	f.dbs[db][id] = doc
+	return rev, true
+}
+
+func (f *fakeCouch) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	path := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	db := path[0]
+
+	switch {
+	case len(db) == 0:
+		w.Write([]byte(`{"couchdb":"Welcome","version":"2.1.1"}`))
+		return
+	case db == "_session":
+		w.Write([]byte(`{"ok":true,"userCtx":{"name":"migration","roles":["_admin"]}}`))
+		return
+	}
+
+	docs, ok := f.dbs[db]
+	if !ok && len(path) == 1 && r.Method == "PUT" {
+		f.dbs[db] = make(map[string]map[string]interface{})
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"ok":true}`))
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"not_found","reason":"Database does not exist."}`))
+		return
+	}
+
+	b, _ := ioutil.ReadAll(r.Body)
+
+	switch {
+	case len(path) == 1:
+		w.Write([]byte(`{}`))
+	case path[1] == "_all_docs":
+		var req struct {
+			Keys []string `json:"keys"`
+		}
+		json.Unmarshal(b, &req)
+
+		var rows []map[string]interface{}
+		for _, key := range req.Keys {
+			if doc, ok := docs[key]; ok {
+				rows = append(rows, map[string]interface{}{"key": key, "doc": doc})
+			} else {
+				rows = append(rows, map[string]interface{}{"key": key, "error": "not_found"})
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"rows": rows})
+	case path[1] == "_index":
+		var req struct {
+			Index struct {
+				Fields []string `json:"fields"`
+			} `json:"index"`
+			Name string `json:"name"`
+		}
+		json.Unmarshal(b, &req)
+
+		if _, ok := f.indexes[db]; !ok {
+			f.indexes[db] = make(map[string][]string)
+		}
+
+		result := "created"
+		if _, ok := f.indexes[db][req.Name]; ok {
+			result = "exists"
+		}
+
+		f.indexes[db][req.Name] = req.Index.Fields
+		json.NewEncoder(w).Encode(map[string]string{"result": result, "id": "_design/" + indexDesignDoc, "name": req.Name})
+	case path[1] == "_bulk_docs":
+		var req struct {
+			Docs []map[string]interface{} `json:"docs"`
+		}
+		json.Unmarshal(b, &req)
+
+		var resp []map[string]string
+		for _, doc := range req.Docs {
+			id := doc["_id"].(string)
+			if e, ok := f.reject[id]; ok {
+				resp = append(resp, map[string]string{"id": id, "error": e, "reason": "rejected by the test"})
+				continue
+			}
+
+			if rev, ok := f.write(db, id, doc); ok {
+				resp = append(resp, map[string]string{"id": id, "rev": rev})
+			} else {
+				resp = append(resp, map[string]string{"id": id, "error": "conflict", "reason": "Document update conflict."})
+			}
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(resp)
+	case r.Method == "GET":
+		doc, ok := docs[path[1]]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"not_found","reason":"missing"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(doc)
+	case r.Method == "PUT":
+		doc := make(map[string]interface{})
+		json.Unmarshal(b, &doc)
+
+		rev, ok := f.write(db, path[1], doc)
+		if !ok {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"conflict","reason":"Document update conflict."}`))
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "id": path[1], "rev": rev})
+	case r.Method == "DELETE":
+		doc, ok := docs[path[1]]
+		if !ok || doc["_rev"] != r.URL.Query().Get("rev") {
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"error":"conflict","reason":"Document update conflict."}`))
+			return
+		}
+
+		delete(docs, path[1])
+		json.NewEncoder(w).Encode(map[string]interface{}{"ok": true, "id": path[1]})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func TestBulkSinkDuplicates(t *testing.T) {
+	f := newFakeCouch("rooms")
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	report := newReport()
+	b := newBulkSink(testCouch(srv.URL, overwriteExisting), 10, report)
+
+	var results []Result
+	results = append(results, b.Put(Document{DB: "rooms", ID: "ITB-1101", Origin: "first", Body: map[string]interface{}{"name": "1101"}})...)
+	results = append(results, b.Put(Document{DB: "rooms", ID: "ITB-1101", Origin: "second", Body: map[string]interface{}{"name": "1101b"}})...)
+	results = append(results, b.Flush()...)
+
+	if len(results) != 2 {
+		t.Fatalf("got %v results, want 2 : %+v", len(results), results)
+	}
+
+	for i, action := range []string{actionCreated, actionUpdated} {
+		if results[i].Action != action {
+			t.Errorf("write %v = %v (%v %v), want %v", i, results[i].Action, results[i].Error, results[i].Reason, action)
+		}
+	}
+
+	if len(report.Warnings) != 1 || !strings.Contains(report.Warnings[0], "generated twice") {
+		t.Errorf("warnings = %q, want one about the document being generated twice", report.Warnings)
+	}
+
+	if doc := f.doc("rooms", "ITB-1101"); doc == nil || doc["name"] != "1101b" {
+		t.Errorf("rooms/ITB-1101 = %v, want the second version", doc)
+	}
+}
+
+func TestBulkSinkPartialFailure(t *testing.T) {
+	f := newFakeCouch("devices")
+	f.reject["ITB-1101-D2"] = "forbidden"
+	f.dbs["devices"]["ITB-1101-D3"] = map[string]interface{}{"_id": "ITB-1101-D3", "_rev": "1-old", "name": "old"}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	b := newBulkSink(testCouch(srv.URL, failExisting), 10, newReport())
+
+	for _, id := range []string{"ITB-1101-D1", "ITB-1101-D2", "ITB-1101-D3"} {
+		if res := b.Put(Document{DB: "devices", ID: id, Body: map[string]interface{}{"name": id}}); len(res) > 0 {
+			t.Fatalf("put %v wrote before the batch was full : %+v", id, res)
+		}
+	}
+
+	results := b.Flush()
+
+	want := map[string]struct {
+		action string
+		status int
+	}{
+		"ITB-1101-D1": {actionCreated, http.StatusCreated},
+		"ITB-1101-D2": {actionFailed, http.StatusForbidden},
+		"ITB-1101-D3": {actionFailed, 0},
+	}
+
+	if len(results) != len(want) {
+		t.Fatalf("got %v results, want %v : %+v", len(results), len(want), results)
+	}
+
+	for _, res := range results {
+		w := want[res.ID]
+		if res.Action != w.action || res.Status != w.status {
+			t.Errorf("%v = %v %v, want %v %v", res.ID, res.Action, res.Status, w.action, w.status)
+		}
+	}
+
+	if f.doc("devices", "ITB-1101-D1") == nil {
+		t.Errorf("devices/ITB-1101-D1 wasn't written")
+	}
+	if f.doc("devices", "ITB-1101-D2") != nil {
+		t.Errorf("devices/ITB-1101-D2 was written after being rejected")
+	}
+	if doc := f.doc("devices", "ITB-1101-D3"); doc["name"] != "old" {
+		t.Errorf("devices/ITB-1101-D3 = %v, want it left alone", doc)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/log"
+)
+
+// how often the checkpoint (and the manifest with it) is saved while a phase is running
+const checkpointInterval = 2 * time.Second
+
+// Checkpoint is the progress of a migration, saved so that an interrupted run can be resumed.
+type Checkpoint struct {
+	Phase           string   `json:"phase"`
+	CompletedPhases []string `json:"completed-phases,omitempty"`
+	LastBuilding    string   `json:"last-building,omitempty"`
+	LastRoom        string   `json:"last-room,omitempty"`
+
+	// Written is every document (db/id) confirmed written
+	Written map[string]bool `json:"written"`
+
+	// Crosswalk is the crosswalk as it was when the last phase finished, so a resumed run that skips those phases still has it
+	Crosswalk []CrosswalkEntry `json:"crosswalk,omitempty"`
+
+	// previous is what was already written when the run was resumed
+	previous map[string]bool
+
+	// finished is the phases that were complete when the run was resumed
+	finished map[string]bool
+
+	// manifest is saved along with the checkpoint, if the run keeps one
+	manifest *Manifest
+
+	// crosswalk is the run's crosswalk, kept in the checkpoint as each phase finishes
+	crosswalk *Crosswalk
+
+	path  string
+	saved time.Time
+	mu    sync.Mutex
+}
+
+// newCheckpoint creates an empty checkpoint that will be saved to path.
+// Nothing is saved if path is empty.
+func newCheckpoint(path string) *Checkpoint {
+	return &Checkpoint{
+		Written: make(map[string]bool),
+		path:    path,
+	}
+}
+
+// loadCheckpoint reads the checkpoint left behind at path by an earlier run.
+func loadCheckpoint(path string) (*Checkpoint, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read checkpoint %v : %v", path, err)
+	}
+
+	c := newCheckpoint(path)
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("unable to parse checkpoint %v : %v", path, err)
+	}
+
+	if c.Written == nil {
+		c.Written = make(map[string]bool)
+	}
+
+	c.previous = make(map[string]bool)
+	for doc := range c.Written {
+		c.previous[doc] = true
+	}
+
+	c.finished = make(map[string]bool)
+	for _, phase := range c.CompletedPhases {
+		c.finished[phase] = true
+	}
+
+	return c, nil
+}
+
+// Add marks every successfully written document in results as written.
+func (c *Checkpoint) Add(results ...Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, res := range results {
+		if res.Action != actionFailed {
+			c.Written[res.DB+"/"+res.ID] = true
+		}
+	}
+}
+
+// IsWritten is true if an earlier run already wrote id to db.
+func (c *Checkpoint) IsWritten(db, id string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.previous[db+"/"+id]
+}
+
+// Finished is true if an earlier run already completed phase.
+func (c *Checkpoint) Finished(phase string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.finished[phase]
+}
+
+// RoomDone records room as the last room completed.
+func (c *Checkpoint) RoomDone(room string) {
+	c.mu.Lock()
+	c.LastRoom = room
+	c.mu.Unlock()
+
+	c.saveEvery(checkpointInterval)
+}
+
+// BuildingDone records building as the last building completed.
+func (c *Checkpoint) BuildingDone(building string) {
+	c.mu.Lock()
+	c.LastBuilding = building
+	c.mu.Unlock()
+
+	c.saveEvery(checkpointInterval)
+}
+
+// StartPhase records that phase is in progress.
+func (c *Checkpoint) StartPhase(phase string) {
+	c.mu.Lock()
+	c.Phase = phase
+	c.mu.Unlock()
+
+	c.save()
+}
+
+// FinishPhase records that phase is complete, along with the crosswalk as it is now.
+func (c *Checkpoint) FinishPhase(phase string) {
+	var entries []CrosswalkEntry
+	if c.crosswalk != nil {
+		entries = c.crosswalk.sorted()
+	}
+
+	c.mu.Lock()
+	c.Crosswalk = entries
+	done := false
+	for _, p := range c.CompletedPhases {
+		done = done || p == phase
+	}
+	if !done {
+		c.CompletedPhases = append(c.CompletedPhases, phase)
+	}
+	c.mu.Unlock()
+
+	c.save()
+}
+
+func (c *Checkpoint) saveEvery(interval time.Duration) {
+	c.mu.Lock()
+	due := time.Since(c.saved) >= interval
+	c.mu.Unlock()
+
+	if due {
+		c.save()
+	}
+}
+
+// save writes the checkpoint, after the manifest so rollback can always undo everything the checkpoint says was written.
+func (c *Checkpoint) save() {
+	if c.manifest != nil {
+		if err := c.manifest.Save(); err != nil {
+			log.L.Errorf("%v", err)
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// the manifest is saved on the same schedule even when the checkpoint isn't
+	if len(c.path) == 0 {
+		c.saved = time.Now()
+		return
+	}
+
+	b, err := json.Marshal(c)
+	if err != nil {
+		log.L.Errorf("Cannot marshal checkpoint : %v", err)
+		return
+	}
+
+	// write to a temp file first so a crash mid-write doesn't lose the old checkpoint
+	tmp := c.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		log.L.Errorf("Unable to write checkpoint : %v", err)
+		return
+	}
+
+	if err := os.Rename(tmp, c.path); err != nil {
+		log.L.Errorf("Unable to write checkpoint : %v", err)
+		return
+	}
+
+	c.saved = time.Now()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// recordSink keeps every document put to it.
+type recordSink struct {
+	docs []Document
+}
+
+func (s *recordSink) Put(doc Document) []Result {
+	s.docs = append(s.docs, doc)
+	return []Result{doc.result(actionCreated)}
+}
+
+func (s *recordSink) Flush() []Result {
+	return nil
+}
+
+func TestResumeCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "checkpoint.json")
+
+	// an earlier run that finished buildings and was stopped part way through rooms
+	earlier := newCheckpoint(path)
+	earlier.crosswalk = newCrosswalk("earlier")
+	earlier.crosswalk.Add(Document{DB: "buildings", ID: "ITB", OldType: "building", OldID: 1})
+
+	earlier.StartPhase("buildings")
+	earlier.Add(Result{DB: "buildings", ID: "ITB", Action: actionCreated})
+	earlier.FinishPhase("buildings")
+
+	earlier.StartPhase("rooms")
+	earlier.Add(Result{DB: "rooms", ID: "ITB-1101", Action: actionCreated}, Result{DB: "rooms", ID: "ITB-1102", Action: actionFailed})
+	earlier.save()
+
+	c, err := loadCheckpoint(path)
+	if err != nil {
+		t.Fatalf("loadCheckpoint : %v", err)
+	}
+
+	selected, err := newScope("", "", "", "", defaultDatabases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &recordSink{}
+	r := &run{
+		sink:       sink,
+		report:     newReport(),
+		selected:   selected,
+		checkpoint: c,
+		manifest:   newManifest("", "", ""),
+		crosswalk:  newCrosswalk("resumed"),
+		dbs:        defaultDatabases,
+	}
+	r.crosswalk.Merge(c.Crosswalk)
+
+	if got, want := r.selectedOnly(allPhases), allPhases[1:]; !reflect.DeepEqual(got, want) {
+		t.Errorf("phases = %v, want %v", got, want)
+	}
+
+	for _, id := range []string{"ITB-1101", "ITB-1102", "ITB-1103"} {
+		r.put(Document{DB: "rooms", ID: id})
+	}
+
+	var put []string
+	for _, doc := range sink.docs {
+		put = append(put, doc.ID)
+	}
+
+	if want := []string{"ITB-1102", "ITB-1103"}; !reflect.DeepEqual(put, want) {
+		t.Errorf("wrote %v, want %v", put, want)
+	}
+
+	if want := []CrosswalkEntry{{Type: "building", OldID: 1, DB: "buildings", ID: "ITB"}}; !reflect.DeepEqual(r.crosswalk.Entries, want) {
+		t.Errorf("crosswalk = %v, want %v", r.crosswalk.Entries, want)
+	}
+}
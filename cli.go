@@ -0,0 +1,328 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/common/log"
+)
+
+const usage = `usage: migration <command> [flags]
+
+commands:
+  migrate               copy the old configuration database into couch
+  plan                  show what migrate would create or update, without writing anything
+  verify                check that what is in couch matches the old configuration database
+  preflight             check that migrate can read the old configuration database and write to couch
+  export <dir>          write the migrated documents to <dir> as JSON files instead of couch
+  rollback <run-id>     undo everything a migrate run created or changed
+  crosswalk <file>      serve a crosswalk of old ids to new ids over HTTP
+  export-source <file>  save the old configuration database to a snapshot (gzipped if <file> ends in .gz)
+
+run 'migration <command> -h' to see the flags for a command.
+`
+
+// the phases of a migration, in the order they run
+var allPhases = []string{"buildings", "room_configurations", "rooms", "devices"}
+
+// options are the settings for a command, read from flags with environment variables as defaults.
+type options struct {
+	// target couch
+	address      string
+	username     string
+	password     string
+	passwordFile string
+	auth         string
+	token        string
+	tokenFile    string
+	proxyRoles   string
+
+	// how requests to couch (and the old config db) are made
+	dbs       databases
+	timeout   time.Duration
+	transport transportSettings
+	retry     retryPolicy
+
+	logLevel    string
+	reportPath  string
+	manifestDir string
+	deadline    time.Duration
+
+	// where the old data comes from
+	snapshot string
+
+	// how documents are written
+	outputDir   string
+	dryRun      bool
+	onExisting  string
+	batchSize   int
+	parallelism int
+	phases      string
+	validate    string
+
+	divergentEvaluators string
+	mappingPath         string
+
+	crosswalkPath string
+	crosswalkDoc  string
+	provenance    bool
+
+	// which part of the old database to migrate
+	building    string
+	room        string
+	designation string
+	only        string
+
+	checkpointPath string
+	resume         bool
+
+	// checks before anything is written
+	skipPreflight bool
+	createDBs     bool
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd, args := os.Args[1], os.Args[2:]
+
+	switch cmd {
+	case "migrate":
+		o := parseFlags(cmd, args, true)
+		runMigrate(o)
+	case "plan":
+		o := parseFlags(cmd, args, true)
+		o.dryRun = true
+		runMigrate(o)
+	case "verify":
+		o := parseFlags(cmd, args, true)
+		runVerify(o)
+	case "preflight":
+		o := parseFlags(cmd, args, true)
+		runPreflight(o)
+	case "export":
+		fs := newFlagSet(cmd, "<dir>")
+		o := addFlags(fs, true)
+		parse(fs, o, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		o.outputDir = fs.Arg(0)
+		runMigrate(o)
+	case "rollback":
+		fs := newFlagSet(cmd, "<run-id>")
+		o := addFlags(fs, false)
+		parse(fs, o, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		runRollback(o, fs.Arg(0))
+	case "crosswalk":
+		fs := newFlagSet(cmd, "<file>")
+		listen := fs.String("listen", ":8080", "address to serve the crosswalk on")
+		o := &options{}
+		fs.StringVar(&o.logLevel, "log-level", envOr("LOG_LEVEL", "info"), "debug, info, warn or error (env LOG_LEVEL)")
+		parse(fs, o, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		runCrosswalkServer(fs.Arg(0), *listen)
+	case "export-source":
+		fs := newFlagSet(cmd, "<file>")
+		o := &options{}
+		fs.StringVar(&o.logLevel, "log-level", envOr("LOG_LEVEL", "info"), "debug, info, warn or error (env LOG_LEVEL)")
+		fs.StringVar(&o.reportPath, "report", "migration-report.json", "where to write the JSON report of the run")
+		fs.IntVar(&o.parallelism, "parallelism", 1, "how many rooms to read at once")
+		fs.DurationVar(&o.timeout, "timeout", time.Minute, "the longest a single request to the old config db can take")
+		fs.DurationVar(&o.deadline, "deadline", 0, "give up if reading the old config db takes longer than this (0 for no limit)")
+		parse(fs, o, args)
+
+		if fs.NArg() != 1 {
+			fs.Usage()
+			os.Exit(2)
+		}
+
+		runExportSource(o, fs.Arg(0))
+	case "help", "-h", "--help":
+		fmt.Fprint(os.Stdout, usage)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%v", cmd, usage)
+		os.Exit(2)
+	}
+}
+
+func newFlagSet(cmd, positional string) *flag.FlagSet {
+	fs := flag.NewFlagSet(cmd, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: migration %v [flags] %v\n\nflags:\n", cmd, positional)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+func parseFlags(cmd string, args []string, migrating bool) *options {
+	fs := newFlagSet(cmd, "")
+	o := addFlags(fs, migrating)
+	parse(fs, o, args)
+
+	if fs.NArg() > 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	return o
+}
+
+// addFlags registers the flags every command shares, plus the ones that control a migration if migrating is set.
+func addFlags(fs *flag.FlagSet, migrating bool) *options {
+	o := &options{
+		dbs:       defaultDatabases,
+		transport: defaultTransport,
+		retry:     defaultRetry,
+	}
+
+	fs.StringVar(&o.address, "address", os.Getenv("DB_ADDRESS"), "address of the target couch (env DB_ADDRESS)")
+	fs.StringVar(&o.username, "username", os.Getenv("DB_USERNAME"), "couch username (env DB_USERNAME)")
+	fs.StringVar(&o.password, "password", os.Getenv("DB_PASSWORD"), "couch password (env DB_PASSWORD)")
+	fs.StringVar(&o.passwordFile, "password-file", os.Getenv("DB_PASSWORD_FILE"), "file to read the couch password from, instead of --password (env DB_PASSWORD_FILE)")
+	fs.StringVar(&o.auth, "auth", envOr("DB_AUTH", authBasic), "how to log in to couch: basic, session, proxy or bearer (env DB_AUTH)")
+	fs.StringVar(&o.token, "token", os.Getenv("DB_TOKEN"), "bearer token, or proxy auth token, for couch (env DB_TOKEN)")
+	fs.StringVar(&o.tokenFile, "token-file", os.Getenv("DB_TOKEN_FILE"), "file to read --token from (env DB_TOKEN_FILE)")
+	fs.StringVar(&o.proxyRoles, "proxy-roles", os.Getenv("DB_PROXY_ROLES"), "comma separated roles to send with proxy auth (env DB_PROXY_ROLES)")
+	fs.StringVar(&o.logLevel, "log-level", envOr("LOG_LEVEL", "info"), "debug, info, warn or error (env LOG_LEVEL)")
+	fs.StringVar(&o.reportPath, "report", "migration-report.json", "where to write the JSON report of the run")
+	fs.StringVar(&o.manifestDir, "manifest-dir", "migration-runs", "where to keep the manifest of each run, used by rollback")
+
+	fs.StringVar(&o.dbs.buildings, "buildings-db", o.dbs.buildings, "name of the buildings database")
+	fs.StringVar(&o.dbs.rooms, "rooms-db", o.dbs.rooms, "name of the rooms database")
+	fs.StringVar(&o.dbs.roomConfigurations, "room-configurations-db", o.dbs.roomConfigurations, "name of the room configurations database")
+	fs.StringVar(&o.dbs.devices, "devices-db", o.dbs.devices, "name of the devices database")
+	fs.StringVar(&o.dbs.deviceTypes, "device-types-db", o.dbs.deviceTypes, "name of the device types database")
+
+	fs.DurationVar(&o.timeout, "timeout", time.Minute, "the longest a single request to couch or the old config db can take")
+	fs.DurationVar(&o.deadline, "deadline", 0, "stop starting new work once the run has taken this long, saving progress like an interrupt (0 for no limit)")
+	fs.IntVar(&o.transport.maxConnsPerHost, "max-conns", o.transport.maxConnsPerHost, "most connections to keep open to couch")
+	fs.BoolVar(&o.transport.gzip, "gzip", false, "gzip request bodies sent to couch")
+	fs.StringVar(&o.transport.caFile, "ca-file", "", "PEM bundle of extra CAs to trust for couch's certificate")
+	fs.StringVar(&o.transport.certFile, "cert-file", "", "client certificate to present to couch")
+	fs.StringVar(&o.transport.keyFile, "key-file", "", "key for --cert-file")
+	fs.BoolVar(&o.transport.insecure, "insecure-skip-verify", false, "don't verify couch's certificate (lab instances only)")
+	fs.IntVar(&o.retry.attempts, "attempts", o.retry.attempts, "most times to try a request to couch that fails with a network error, 429, 500, 502 or 503")
+	fs.DurationVar(&o.retry.delay, "retry-delay", o.retry.delay, "how long to wait before retrying a failed request, doubled for each retry after")
+	fs.DurationVar(&o.retry.maxDelay, "max-retry-delay", o.retry.maxDelay, "the longest to wait between retries")
+	fs.IntVar(&o.retry.breakerThreshold, "breaker-threshold", o.retry.breakerThreshold, "pause the run after this many failed requests in a row (0 never pauses)")
+	fs.DurationVar(&o.retry.breakerPause, "breaker-pause", o.retry.breakerPause, "how long to pause the run for once the target keeps failing")
+
+	if !migrating {
+		return o
+	}
+
+	fs.StringVar(&o.snapshot, "source-snapshot", os.Getenv("SOURCE_SNAPSHOT"), "read the old configuration database from this JSON snapshot instead of the live service (env SOURCE_SNAPSHOT)")
+	fs.StringVar(&o.outputDir, "output-dir", os.Getenv("OUTPUT_DIR"), "write JSON files into this directory instead of couch (env OUTPUT_DIR)")
+	fs.StringVar(&o.onExisting, "on-existing", string(overwriteExisting), "what to do with documents that already exist with different content: overwrite, skip or fail")
+	fs.IntVar(&o.batchSize, "batch-size", 0, "write documents to couch through _bulk_docs, this many at a time (0 writes them one by one)")
+	fs.IntVar(&o.parallelism, "parallelism", 1, "how many rooms to process at once")
+	fs.StringVar(&o.phases, "phases", strings.Join(allPhases, ","), "comma separated phases to run")
+	fs.StringVar(&o.validate, "validate", validateWarn, "check references between documents before writing: off, warn (report them) or block (write nothing if any dangle)")
+	fs.StringVar(&o.crosswalkPath, "crosswalk", "migration-crosswalk", "write the old id to new id crosswalk of the run to this path, as .json and .csv, merged into the one already there if the run is scoped (empty to not write it)")
+	fs.StringVar(&o.crosswalkDoc, "crosswalk-doc", "", "also write the crosswalk as a document, <db>/<id>")
+	fs.BoolVar(&o.provenance, "provenance", false, "stamp every document with where it came from (old id, run id, version and time) in a \"migration\" field")
+	fs.StringVar(&o.mappingPath, "mapping", os.Getenv("MAPPING_FILE"), "YAML or JSON file of id templates, field sources and rename tables to use instead of the built in mapping (env MAPPING_FILE)")
+	fs.StringVar(&o.divergentEvaluators, "divergent-evaluators", divergentReport, "what to do when rooms sharing a room configuration have different evaluators: report (and use the most common set) or split (into one configuration per set)")
+	fs.StringVar(&o.building, "building", "", "comma separated building shortnames to migrate (ITB, case sensitive)")
+	fs.StringVar(&o.room, "room", "", "comma separated room ids to migrate (ITB-1101, case sensitive)")
+	fs.StringVar(&o.designation, "designation", "", "comma separated room designations to migrate (production, case sensitive)")
+	fs.StringVar(&o.only, "only", "", "comma separated databases to write: buildings, rooms, room_configurations, devices, device_types")
+	fs.StringVar(&o.checkpointPath, "checkpoint", "migration-checkpoint.json", "where to save the progress of the run")
+	fs.BoolVar(&o.resume, "resume", false, "pick up from the checkpoint left by an interrupted run, skipping everything it already wrote")
+	fs.BoolVar(&o.skipPreflight, "skip-preflight", false, "don't check the old config db and the target databases before writing")
+	fs.BoolVar(&o.createDBs, "create-dbs", false, "create target databases that don't exist yet during preflight")
+
+	return o
+}
+
+func parse(fs *flag.FlagSet, o *options, args []string) {
+	fs.Parse(args)
+
+	if err := log.SetLevel(o.logLevel); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid log level %q : %v\n", o.logLevel, err.Error())
+		os.Exit(2)
+	}
+
+	// only the commands that talk to couch have these
+	if fs.Lookup("max-conns") == nil {
+		return
+	}
+
+	if o.transport.maxConnsPerHost < 1 {
+		fmt.Fprintf(os.Stderr, "invalid --max-conns %v : must be at least 1\n", o.transport.maxConnsPerHost)
+		os.Exit(2)
+	}
+
+	if o.retry.attempts < 1 {
+		fmt.Fprintf(os.Stderr, "invalid --attempts %v : must be at least 1\n", o.retry.attempts)
+		os.Exit(2)
+	}
+
+	switch o.auth {
+	case authBasic, authSession, authProxy, authBearer:
+	default:
+		fmt.Fprintf(os.Stderr, "invalid --auth %q : must be basic, session, proxy or bearer\n", o.auth)
+		os.Exit(2)
+	}
+}
+
+// selectedPhases returns the phases listed in o.phases, in the order they run.
+func (o *options) selectedPhases() ([]string, error) {
+	want := make(map[string]bool)
+	for _, p := range strings.Split(o.phases, ",") {
+		p = strings.TrimSpace(p)
+		if len(p) == 0 {
+			continue
+		}
+
+		known := false
+		for _, a := range allPhases {
+			known = known || a == p
+		}
+
+		if !known {
+			return nil, fmt.Errorf("unknown phase %q (must be one of %v)", p, strings.Join(allPhases, ", "))
+		}
+
+		want[p] = true
+	}
+
+	var phases []string
+	for _, p := range allPhases {
+		if want[p] {
+			phases = append(phases, p)
+		}
+	}
+
+	return phases, nil
+}
+
+func envOr(key, def string) string {
+	if v := os.Getenv(key); len(v) > 0 {
+		return v
+	}
+
+	return def
+}
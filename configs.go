@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/byuoitav/configuration-database-microservice/structs"
+
+	newstructs "github.com/byuoitav/common/structs"
+)
+
+// what happens when rooms sharing a room configuration have different evaluators
+const (
+	divergentReport = "report"
+	divergentSplit  = "split"
+)
+
+// configVariant is one distinct set of evaluators found among the rooms of a room configuration.
+type configVariant struct {
+	ID         string
+	Evaluators []newstructs.Evaluator
+	Rooms      []string
+
+	// Err is why the id or evaluators couldn't be mapped, if they couldn't
+	Err error
+}
+
+// configVariants is everything roomConfigurationVariants works out, once per run.
+type configVariants struct {
+	once sync.Once
+
+	// the variants of each room configuration (by old id), the most common first
+	byConfig map[int][]*configVariant
+
+	// the variant each room (ITB-1101) ends up using
+	rooms map[string]*configVariant
+}
+
+// roomConfigurationVariants looks at the evaluators of every room and groups the rooms of each room
+// configuration by them. When rooms disagree the most common set is used for the configuration itself,
+// and the others are either reported, or split into configurations of their own (named <config>-2, <config>-3...).
+// It only runs once, later calls return the same result.
+func (r *run) roomConfigurationVariants() map[int][]*configVariant {
+	r.variants.once.Do(func() {
+		r.variants.byConfig = make(map[int][]*configVariant)
+		r.variants.rooms = make(map[string]*configVariant)
+
+		// the evaluators of each room, by configuration
+		byConfig := make(map[int]map[string]*configVariant)
+
+		// rooms outside the scope count too, so the variants (and their ids) are the same whichever rooms are selected
+		for _, room := range allRoomList {
+			if _, ok := configMap[room.ConfigurationID]; !ok {
+				continue
+			}
+
+			fullRoom, ok := fullRoomMap[roomKey(room)]
+			if !ok {
+				// already reported when it couldn't be read
+				continue
+			}
+
+			evals, err := convertEvaluators(fullRoom.Configuration.Evaluators)
+			key, _ := json.Marshal(evals)
+
+			if _, ok := byConfig[room.ConfigurationID]; !ok {
+				byConfig[room.ConfigurationID] = make(map[string]*configVariant)
+			}
+
+			v, ok := byConfig[room.ConfigurationID][string(key)]
+			if !ok {
+				v = &configVariant{Evaluators: evals, Err: err}
+				byConfig[room.ConfigurationID][string(key)] = v
+			}
+
+			v.Rooms = append(v.Rooms, roomKey(room))
+		}
+
+		for _, c := range configList {
+			var variants []*configVariant
+			for _, v := range byConfig[c.ID] {
+				sort.Strings(v.Rooms)
+				variants = append(variants, v)
+			}
+
+			// most rooms first, ties broken by the first room so the names are the same every run
+			sort.Slice(variants, func(i, j int) bool {
+				if len(variants[i].Rooms) != len(variants[j].Rooms) {
+					return len(variants[i].Rooms) > len(variants[j].Rooms)
+				}
+
+				return variants[i].Rooms[0] < variants[j].Rooms[0]
+			})
+
+			// a configuration no room uses still gets written, just without evaluators
+			if len(variants) == 0 {
+				variants = []*configVariant{{}}
+			}
+
+			for i, v := range variants {
+				id, err := roomConfigurationID(c)
+				if v.Err == nil {
+					v.Err = err
+				}
+
+				v.ID = id
+				if i > 0 && r.divergent == divergentSplit {
+					v.ID = fmt.Sprintf("%s-%d", v.ID, i+1)
+				}
+
+				// when only the first variant is written every room uses it, and fails along with it
+				for _, room := range v.Rooms {
+					if r.divergent == divergentSplit {
+						r.variants.rooms[room] = v
+					} else {
+						r.variants.rooms[room] = variants[0]
+					}
+				}
+			}
+
+			if len(variants) > 1 {
+				r.reportDivergent(c, variants)
+			}
+
+			if r.divergent == divergentReport {
+				variants = variants[:1]
+			}
+
+			r.variants.byConfig[c.ID] = variants
+		}
+	})
+
+	return r.variants.byConfig
+}
+
+func (r *run) reportDivergent(c structs.RoomConfiguration, variants []*configVariant) {
+	var described []string
+	for _, v := range variants {
+		var keys []string
+		for _, e := range v.Evaluators {
+			keys = append(keys, fmt.Sprintf("%v (%v)", e.ID, e.Priority))
+		}
+
+		described = append(described, fmt.Sprintf("[%v] in %v", strings.Join(keys, ", "), sample(v.Rooms)))
+	}
+
+	if r.divergent == divergentSplit {
+		var ids []string
+		for _, v := range variants[1:] {
+			ids = append(ids, v.ID)
+		}
+
+		r.report.Warnf("Rooms using room configuration %v have %v different sets of evaluators, split into %v : %v", c.Name, len(variants), strings.Join(ids, ", "), strings.Join(described, "; "))
+		return
+	}
+
+	r.report.Warnf("Rooms using room configuration %v have %v different sets of evaluators, using the first : %v", c.Name, len(variants), strings.Join(described, "; "))
+}
+
+func convertEvaluators(old []structs.Evaluator) ([]newstructs.Evaluator, error) {
+	evals := make([]newstructs.Evaluator, len(old))
+
+	var errs mapErrors
+	for j, e := range old {
+		key := mapping.Evaluator(e.EvaluatorKey)
+		values := map[string]interface{}{"Evaluator": key, "Old": e}
+
+		evals[j].ID = key
+		evals[j].CodeKey = errs.keep(mapping.Field("evaluator.code_key", values))
+		evals[j].Priority = e.Priority
+		evals[j].Description = errs.keep(mapping.Field("evaluator.description", values))
+	}
+
+	return evals, errs.err
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/byuoitav/configuration-database-microservice/structs"
+)
+
+// testRun is a run that writes everything to sink, with the old database already loaded into the globals.
+func testRun(sink Sink, divergent string) *run {
+	selected, _ := newScope("", "", "", "", defaultDatabases)
+
+	return &run{
+		sink:        sink,
+		report:      newReport(),
+		selected:    selected,
+		checkpoint:  newCheckpoint(""),
+		manifest:    newManifest("", "", ""),
+		crosswalk:   newCrosswalk(""),
+		dbs:         defaultDatabases,
+		parallelism: 1,
+		divergent:   divergent,
+	}
+}
+
+func TestSplitRoomConfigurations(t *testing.T) {
+	itb := structs.Building{ID: 1, Shortname: "ITB"}
+	config := structs.RoomConfiguration{ID: 1, Name: "Default"}
+
+	room := func(id int, name string, evaluators ...string) structs.Room {
+		c := config
+		for i, key := range evaluators {
+			c.Evaluators = append(c.Evaluators, structs.Evaluator{ID: i, EvaluatorKey: key, Priority: i})
+		}
+
+		return structs.Room{ID: id, Name: name, Building: itb, ConfigurationID: config.ID, Configuration: c}
+	}
+
+	// two rooms agree, the third has an evaluator of its own
+	rooms := []structs.Room{
+		room(1, "1101", "STATUS"),
+		room(2, "1102", "STATUS"),
+		room(3, "1103", "STATUS", "PROJECTOR"),
+	}
+
+	shortnameMap = map[int]string{itb.ID: itb.Shortname}
+	configList = []structs.RoomConfiguration{config}
+	configMap = map[int]structs.RoomConfiguration{config.ID: config}
+	roomList, allRoomList = rooms, rooms
+
+	fullRoomMap = make(map[string]structs.Room)
+	for _, r := range rooms {
+		fullRoomMap[roomKey(r)] = r
+	}
+
+	sink := &recordSink{}
+	r := testRun(sink, divergentSplit)
+	r.moveRoomConfigurations(context.Background())
+	r.moveRooms(context.Background())
+
+	var configs []string
+	usesConfig := make(map[string]string)
+	for _, doc := range sink.docs {
+		switch doc.DB {
+		case r.dbs.roomConfigurations:
+			configs = append(configs, doc.ID)
+		case r.dbs.rooms:
+			b, _ := toMap(doc.Body)
+			usesConfig[doc.ID] = b["configuration"].(map[string]interface{})["_id"].(string)
+		}
+	}
+
+	if want := []string{"Default", "Default-2"}; !reflect.DeepEqual(configs, want) {
+		t.Errorf("room configurations = %v, want %v", configs, want)
+	}
+
+	want := map[string]string{"ITB-1101": "Default", "ITB-1102": "Default", "ITB-1103": "Default-2"}
+	if !reflect.DeepEqual(usesConfig, want) {
+		t.Errorf("rooms use %v, want %v", usesConfig, want)
+	}
+
+	if len(r.report.Warnings) != 1 {
+		t.Errorf("warnings = %q, want one about the split", r.report.Warnings)
+	}
+
+	// a variant that can't be written takes its rooms with it
+	sink = &recordSink{}
+	r = testRun(sink, divergentSplit)
+	r.roomConfigurationVariants()[config.ID][1].Err = errTest
+	r.moveRooms(context.Background())
+
+	if len(sink.docs) != 2 || len(r.report.Failures) != 1 || r.report.Failures[0].ID != "ITB-1103" {
+		t.Errorf("wrote %v rooms and failed %+v, want only ITB-1103 failed", len(sink.docs), r.report.Failures)
+	}
+}
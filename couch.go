@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/byuoitav/common/log"
+)
+
+// couchSink writes documents into CouchDB.
+type couchSink struct {
+	// ctx is the run's context: once it is done, waits between retries end early.
+	// Requests that have already been sent are still finished.
+	ctx context.Context
+
+	address string
+	auth    authenticator
+	policy  existingPolicy
+
+	client  *http.Client
+	gzip    bool
+	timeout time.Duration // the longest a single request can take
+	retry   retryPolicy
+	breaker *breaker
+
+	// docs is held while a document is being read and rewritten, so parallel puts of it don't conflict
+	docs keyedMutex
+}
+
+// newCouchSink writes to the couch o points at for a run working under ctx, exiting if o's credentials can't be loaded.
+func newCouchSink(ctx context.Context, o *options, policy existingPolicy) *couchSink {
+	return &couchSink{
+		ctx:     ctx,
+		address: o.address,
+		auth:    o.couchAuth(),
+		policy:  policy,
+		client:  couchClient(o.transport),
+		gzip:    o.transport.gzip,
+		timeout: o.timeout,
+		retry:   o.retry,
+		breaker: newBreaker(o.retry.breakerThreshold, o.retry.breakerPause),
+	}
+}
+
+// couchError is the body couch sends back with a failed request.
+type couchError struct {
+	Error  string `json:"error"`
+	Reason string `json:"reason"`
+}
+
+// couchOK is the body couch sends back when a document is written.
+type couchOK struct {
+	ID  string `json:"id"`
+	Rev string `json:"rev"`
+}
+
+func parseCouchError(body []byte) couchError {
+	var ce couchError
+	if err := json.Unmarshal(body, &ce); err != nil || len(ce.Error) == 0 {
+		ce.Error = string(body)
+	}
+
+	return ce
+}
+
+// do sends a request to path (relative to the couch address) and returns the status and body of the response.
+// Network errors and responses that mean couch is overloaded or broken are retried with backoff, up to c.retry.attempts times.
+//
+// A 401 is sent again once if the authenticator renews its credentials, without counting as an attempt.
+func (c *couchSink) do(method, path string, body []byte) (int, []byte, error) {
+	status, b, _, err := c.send(method, path, body)
+	return status, b, err
+}
+
+// send is do, also returning how many attempts it took. A write that reached couch but whose response
+// was lost comes back as a conflict when it is retried, so writers check with landed when that happens.
+func (c *couchSink) send(method, path string, body []byte) (int, []byte, int, error) {
+	encoding := ""
+	if c.gzip && len(body) > 0 {
+		zipped, err := gzipBody(body)
+		if err != nil {
+			return 0, nil, 0, fmt.Errorf("unable to compress request : %v", err)
+		}
+
+		body, encoding = zipped, "gzip"
+	}
+
+	refreshed := false
+
+	for n := 1; ; n++ {
+		if err := c.breaker.wait(c.ctx); err != nil {
+			return 0, nil, n - 1, fmt.Errorf("stopped while waiting for couch to recover : %v", err)
+		}
+
+		status, b, header, err := c.attempt(method, path, body, encoding)
+		if err == nil && status == http.StatusUnauthorized && !refreshed {
+			refreshed = true
+			if c.auth.refresh() {
+				log.L.Infof("%v %v was unauthorized, trying again with new credentials", method, path)
+				n--
+				continue
+			}
+		}
+
+		if err == nil && !retryable(status) {
+			c.breaker.success()
+			return status, b, n, nil
+		}
+
+		c.breaker.failure()
+
+		if n >= c.retry.attempts {
+			if err != nil {
+				return status, b, n, fmt.Errorf("%v (gave up after %v attempts)", err, n)
+			}
+
+			return status, b, n, nil
+		}
+
+		wait := c.retry.backoff(n, header)
+		if err != nil {
+			log.L.Infof("%v %v failed, trying again in %v : %v", method, path, wait, err)
+		} else {
+			log.L.Infof("%v %v returned %v, trying again in %v", method, path, status, wait)
+		}
+
+		if !sleep(c.ctx, wait) {
+			if err != nil {
+				return status, b, n, fmt.Errorf("%v (stopped before trying again)", err)
+			}
+
+			return status, b, n, nil
+		}
+	}
+}
+
+// attempt sends a single request, with a body already encoded as encoding (if it isn't empty).
+func (c *couchSink) attempt(method, path string, body []byte, encoding string) (int, []byte, http.Header, error) {
+	url := fmt.Sprintf("%v/%v", c.address, path)
+
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+
+	// requests in progress are always finished, so only the timeout can cut them short
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	defer cancel()
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("error making request : %v", err)
+	}
+	req = req.WithContext(ctx)
+
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if len(encoding) > 0 {
+		req.Header.Set("Content-Encoding", encoding)
+	}
+
+	if err := c.auth.authorize(req); err != nil {
+		return 0, nil, nil, fmt.Errorf("unable to authorize request : %v", err)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return 0, nil, nil, fmt.Errorf("error doing request : %v", err)
+	}
+	defer resp.Body.Close()
+
+	c.auth.observe(resp)
+
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, nil, resp.Header, fmt.Errorf("unable to read response : %v", err)
+	}
+
+	return resp.StatusCode, b, resp.Header, nil
+}
+
+func (c *couchSink) Put(doc Document) []Result {
+	defer c.docs.Lock(doc.DB + "/" + doc.ID)()
+
+	have, err := c.Get(doc.DB, doc.ID)
+	if err != nil {
+		return []Result{doc.failed(err)}
+	}
+
+	action, err := decide(c.policy, doc, have)
+	if err != nil {
+		return []Result{doc.failed(err)}
+	}
+	if action != actionCreated && action != actionUpdated {
+		return []Result{doc.result(action)}
+	}
+
+	m, err := toMap(doc.Body)
+	if err != nil {
+		return []Result{doc.failed(fmt.Errorf("cannot marshal %v/%v : %v", doc.DB, doc.ID, err))}
+	}
+
+	// updating an existing document requires its current revision
+	if have != nil {
+		m["_rev"] = have["_rev"]
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return []Result{doc.failed(fmt.Errorf("cannot marshal %v/%v : %v", doc.DB, doc.ID, err))}
+	}
+
+	status, b, attempts, err := c.send("PUT", fmt.Sprintf("%v/%v", doc.DB, doc.ID), body)
+	if err != nil {
+		return []Result{doc.failed(err)}
+	}
+
+	res := doc.result(action)
+	res.Status = status
+	res.Previous = have
+
+	if status == http.StatusConflict && attempts > 1 {
+		current, err := c.Get(doc.DB, doc.ID)
+		if err == nil && landed(doc, current) {
+			res.Status = http.StatusCreated
+			res.Rev, _ = current["_rev"].(string)
+			return []Result{res}
+		}
+	}
+
+	if status/100 != 2 {
+		ce := parseCouchError(b)
+
+		res.Action = actionFailed
+		res.Error = ce.Error
+		res.Reason = ce.Reason
+		return []Result{res}
+	}
+
+	var ok couchOK
+	if err := json.Unmarshal(b, &ok); err == nil {
+		res.Rev = ok.Rev
+	}
+
+	return []Result{res}
+}
+
+// Flush does nothing, every Put is written immediately.
+func (c *couchSink) Flush() []Result {
+	return nil
+}
+
+// landed is true if current (the document as it is in couch now) is exactly what doc was going to write,
+// meaning a write that was retried and then conflicted actually went through on an earlier attempt.
+func landed(doc Document, current map[string]interface{}) bool {
+	if current == nil {
+		return false
+	}
+
+	want, err := toMap(doc.Body)
+	if err != nil || len(diffDocs(current, want)) > 0 {
+		return false
+	}
+
+	log.L.Infof("%v/%v was written by an earlier attempt whose response was lost", doc.DB, doc.ID)
+	return true
+}
+
+func (c *couchSink) Get(db, id string) (map[string]interface{}, error) {
+	status, body, err := c.do("GET", fmt.Sprintf("%v/%v", db, id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if status/100 != 2 {
+		return nil, fmt.Errorf("unable to get %v/%v : %v %s", db, id, status, body)
+	}
+
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse %v/%v : %v", db, id, err)
+	}
+
+	return doc, nil
+}
+
+// Delete removes revision rev of id from db.
+func (c *couchSink) Delete(db, id, rev string) (int, error) {
+	status, body, attempts, err := c.send("DELETE", fmt.Sprintf("%v/%v?rev=%v", db, id, url.QueryEscape(rev)), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	// an earlier attempt may have deleted it without the response making it back
+	if status == http.StatusConflict && attempts > 1 {
+		if current, err := c.Get(db, id); err == nil && current == nil {
+			log.L.Infof("%v/%v was deleted by an earlier attempt whose response was lost", db, id)
+			return http.StatusOK, nil
+		}
+	}
+
+	if status/100 != 2 {
+		ce := parseCouchError(body)
+		return status, fmt.Errorf("unable to delete %v/%v : %v %v", db, id, ce.Error, ce.Reason)
+	}
+
+	return status, nil
+}
+
+// IDs lists every document in db, leaving out design documents.
+func (c *couchSink) IDs(db string) ([]string, error) {
+	status, body, err := c.do("GET", fmt.Sprintf("%v/_all_docs", db), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if status/100 != 2 {
+		return nil, fmt.Errorf("unable to list %v : %v %s", db, status, body)
+	}
+
+	var resp allDocsResponse
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("unable to parse %v : %v", db, err)
+	}
+
+	var ids []string
+	for _, row := range resp.Rows {
+		if !strings.HasPrefix(row.Key, "_design/") {
+			ids = append(ids, row.Key)
+		}
+	}
+
+	return ids, nil
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// retryingCouch is a couch sink for address that retries straight away.
+func retryingCouch(address string, attempts int) *couchSink {
+	c := testCouch(address, overwriteExisting)
+	c.retry = retryPolicy{attempts: attempts, delay: time.Millisecond, maxDelay: time.Millisecond}
+
+	return c
+}
+
+func TestCouchRetry(t *testing.T) {
+	f := newFakeCouch("buildings")
+	f.dbs["buildings"]["ITB"] = map[string]interface{}{"_id": "ITB", "_rev": "1-a", "name": "ITB"}
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		f.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	doc, err := retryingCouch(srv.URL, 3).Get("buildings", "ITB")
+	if err != nil || doc == nil || doc["name"] != "ITB" {
+		t.Errorf("Get = %v, %v, want buildings/ITB", doc, err)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("made %v requests, want 2", calls)
+	}
+}
+
+func TestCouchLostResponse(t *testing.T) {
+	f := newFakeCouch("buildings")
+
+	// the first write goes through, but its response never makes it back
+	var puts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "PUT" && atomic.AddInt32(&puts, 1) == 1 {
+			f.ServeHTTP(httptest.NewRecorder(), r)
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+
+		f.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	results := retryingCouch(srv.URL, 3).Put(Document{DB: "buildings", ID: "ITB", Body: map[string]interface{}{"name": "ITB"}})
+	if len(results) != 1 {
+		t.Fatalf("got %v results, want 1", len(results))
+	}
+
+	res := results[0]
+	if res.Action != actionCreated || res.Status != http.StatusCreated || res.Rev != f.doc("buildings", "ITB")["_rev"] {
+		t.Errorf("Put = %+v, want buildings/ITB created at %v", res, f.doc("buildings", "ITB")["_rev"])
+	}
+	if puts := atomic.LoadInt32(&puts); puts != 2 {
+		t.Errorf("made %v writes, want 2", puts)
+	}
+}
+
+func TestCouchBreaker(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := retryingCouch(srv.URL, 1)
+	c.ctx = ctx
+	c.breaker = newBreaker(2, time.Hour)
+
+	for i := 0; i < 2; i++ {
+		if _, err := c.Get("buildings", "ITB"); err == nil {
+			t.Errorf("Get %v succeeded against a failing couch", i)
+		}
+	}
+
+	// the breaker is open now, so the next request waits until the run is stopped
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	_, err := c.Get("buildings", "ITB")
+	if err == nil || !strings.Contains(err.Error(), "stopped") {
+		t.Errorf("Get = %v, want it stopped while waiting", err)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond || waited > 5*time.Second {
+		t.Errorf("Get waited %v, want it to wait until the run was stopped", waited)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 2 {
+		t.Errorf("made %v requests, want 2", calls)
+	}
+}
+
+func TestCouchStoppedBackoff(t *testing.T) {
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	c := testCouch(srv.URL, overwriteExisting)
+	c.ctx = ctx
+	c.retry = retryPolicy{attempts: 5, delay: time.Hour, maxDelay: time.Hour}
+
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	status, _, err := c.do("GET", "buildings/ITB", nil)
+	if err != nil || status != http.StatusServiceUnavailable {
+		t.Errorf("do = %v, %v, want the 503 it was retrying", status, err)
+	}
+	if waited := time.Since(start); waited > 5*time.Second {
+		t.Errorf("do waited %v, want it to stop waiting when the run was stopped", waited)
+	}
+	if calls := atomic.LoadInt32(&calls); calls != 1 {
+		t.Errorf("made %v requests, want 1", calls)
+	}
+}
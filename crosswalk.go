@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/byuoitav/common/log"
+)
+
+// Crosswalk maps the numeric ids of the old configuration database to the ids of the documents built from them.
+type Crosswalk struct {
+	RunID   string           `json:"run-id"`
+	Entries []CrosswalkEntry `json:"entries"`
+
+	// index is the position of each entry (type/old id/db/id) in Entries
+	index map[string]int
+	mu    sync.Mutex
+}
+
+// CrosswalkEntry is one old record and a document built from it. A record can have
+// more than one entry, e.g. a room configuration split by its evaluators.
+type CrosswalkEntry struct {
+	Type  string `json:"type"`
+	OldID int    `json:"old-id"`
+	DB    string `json:"db"`
+	ID    string `json:"id"`
+}
+
+func newCrosswalk(runID string) *Crosswalk {
+	return &Crosswalk{
+		RunID: runID,
+		index: make(map[string]int),
+	}
+}
+
+// Add records that doc was built from the old record it names. Documents without one are ignored.
+func (c *Crosswalk) Add(doc Document) {
+	if len(doc.OldType) == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := fmt.Sprintf("%v/%v/%v/%v", doc.OldType, doc.OldID, doc.DB, doc.ID)
+	if _, ok := c.index[key]; ok {
+		return
+	}
+
+	c.index[key] = len(c.Entries)
+	c.Entries = append(c.Entries, CrosswalkEntry{
+		Type:  doc.OldType,
+		OldID: doc.OldID,
+		DB:    doc.DB,
+		ID:    doc.ID,
+	})
+}
+
+// Merge keeps the entries of older for every old record c has nothing for, so a run that only
+// covers part of the old database doesn't drop the rest of the crosswalk it replaces.
+func (c *Crosswalk) Merge(older []CrosswalkEntry) {
+	c.mu.Lock()
+	covered := make(map[string]bool)
+	for _, e := range c.Entries {
+		covered[fmt.Sprintf("%v/%v", e.Type, e.OldID)] = true
+	}
+	c.mu.Unlock()
+
+	for _, e := range older {
+		if covered[fmt.Sprintf("%v/%v", e.Type, e.OldID)] {
+			continue
+		}
+
+		c.Add(Document{DB: e.DB, ID: e.ID, OldType: e.Type, OldID: e.OldID})
+	}
+}
+
+// sorted returns the entries by type, then old id.
+func (c *Crosswalk) sorted() []CrosswalkEntry {
+	c.mu.Lock()
+	entries := append([]CrosswalkEntry(nil), c.Entries...)
+	c.mu.Unlock()
+
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].Type != entries[j].Type {
+			return entries[i].Type < entries[j].Type
+		}
+
+		return entries[i].OldID < entries[j].OldID
+	})
+
+	return entries
+}
+
+// Save writes the crosswalk to <path>.json and <path>.csv.
+func (c *Crosswalk) Save(path string) error {
+	entries := c.sorted()
+
+	b, err := json.MarshalIndent(&Crosswalk{RunID: c.RunID, Entries: entries}, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot marshal crosswalk : %v", err)
+	}
+
+	if err := ioutil.WriteFile(path+".json", b, 0644); err != nil {
+		return fmt.Errorf("unable to write crosswalk to %v.json : %v", path, err)
+	}
+
+	f, err := os.Create(path + ".csv")
+	if err != nil {
+		return fmt.Errorf("unable to write crosswalk to %v.csv : %v", path, err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"type", "old_id", "db", "id"})
+	for _, e := range entries {
+		w.Write([]string{e.Type, strconv.Itoa(e.OldID), e.DB, e.ID})
+	}
+
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("unable to write crosswalk to %v.csv : %v", path, err)
+	}
+
+	return nil
+}
+
+// Document is the crosswalk as a document to be written to db/id.
+func (c *Crosswalk) Document(db, id string) Document {
+	return Document{
+		DB:     db,
+		ID:     id,
+		Origin: fmt.Sprintf("crosswalk for run %v", c.RunID),
+		Body: map[string]interface{}{
+			"run-id":  c.RunID,
+			"entries": c.sorted(),
+		},
+	}
+}
+
+// loadCrosswalk reads a crosswalk saved by Save.
+func loadCrosswalk(path string) (*Crosswalk, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read crosswalk : %v", err)
+	}
+
+	c := &Crosswalk{}
+	if err := json.Unmarshal(b, c); err != nil {
+		return nil, fmt.Errorf("unable to parse crosswalk %v : %v", path, err)
+	}
+
+	return c, nil
+}
+
+// crosswalkHandler answers GET /crosswalk/<type>/<old id> with the entries for that old record,
+// and GET /crosswalk with the whole crosswalk.
+func crosswalkHandler(c *Crosswalk) http.Handler {
+	lookup := make(map[string][]CrosswalkEntry)
+	for _, e := range c.Entries {
+		key := fmt.Sprintf("%v/%v", e.Type, e.OldID)
+		lookup[key] = append(lookup[key], e)
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		key := strings.Trim(strings.TrimPrefix(r.URL.Path, "/crosswalk"), "/")
+		if len(key) == 0 {
+			writeJSON(w, http.StatusOK, c)
+			return
+		}
+
+		parts := strings.Split(key, "/")
+		if len(parts) != 2 {
+			http.Error(w, "expected /crosswalk/<type>/<old id>", http.StatusBadRequest)
+			return
+		}
+
+		if _, err := strconv.Atoi(parts[1]); err != nil {
+			http.Error(w, fmt.Sprintf("invalid old id %q", parts[1]), http.StatusBadRequest)
+			return
+		}
+
+		entries, ok := lookup[key]
+		if !ok {
+			http.Error(w, fmt.Sprintf("no %v with old id %v", parts[0], parts[1]), http.StatusNotFound)
+			return
+		}
+
+		writeJSON(w, http.StatusOK, entries)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.L.Warnf("Failed to write response : %v", err)
+	}
+}
+
+// runCrosswalkServer serves the crosswalk at path over HTTP until the process is stopped.
+func runCrosswalkServer(path, listen string) {
+	c, err := loadCrosswalk(path)
+	if err != nil {
+		log.L.Fatalf("Failed to load crosswalk : %v", err)
+	}
+
+	h := crosswalkHandler(c)
+	http.Handle("/crosswalk", h)
+	http.Handle("/crosswalk/", h)
+
+	log.L.Infof("Serving %v entries from crosswalk %v on %v", len(c.Entries), c.RunID, listen)
+	log.L.Fatalf("%v", http.ListenAndServe(listen, nil))
+}
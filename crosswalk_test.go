@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestScopedCrosswalkMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "crosswalk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	o := &options{crosswalkPath: filepath.Join(dir, "migration-crosswalk")}
+
+	// a full run
+	r := testRun(&recordSink{}, divergentReport)
+	r.crosswalk.Add(Document{DB: "rooms", ID: "ITB-1101", OldType: "room", OldID: 1})
+	r.crosswalk.Add(Document{DB: "rooms", ID: "ITB-1102", OldType: "room", OldID: 2})
+	r.saveCrosswalk(o, allPhases, nil)
+
+	// then one room again, under its new id
+	r = testRun(&recordSink{}, divergentReport)
+	r.selected, _ = newScope("", "ITB-1101", "", "", defaultDatabases)
+	r.crosswalk.Add(Document{DB: "rooms", ID: "ITB-1101A", OldType: "room", OldID: 1})
+	r.saveCrosswalk(o, allPhases, nil)
+
+	c, err := loadCrosswalk(o.crosswalkPath + ".json")
+	if err != nil {
+		t.Fatalf("loadCrosswalk : %v", err)
+	}
+
+	want := []CrosswalkEntry{
+		{Type: "room", OldID: 1, DB: "rooms", ID: "ITB-1101A"},
+		{Type: "room", OldID: 2, DB: "rooms", ID: "ITB-1102"},
+	}
+	if !reflect.DeepEqual(c.Entries, want) {
+		t.Errorf("crosswalk = %v, want %v", c.Entries, want)
+	}
+}
+
+func TestCrosswalkHandler(t *testing.T) {
+	c := newCrosswalk("test")
+	c.Add(Document{DB: "rooms", ID: "ITB-1101", OldType: "room", OldID: 1})
+	c.Add(Document{DB: "room_configurations", ID: "Default", OldType: "room_configuration", OldID: 1})
+	c.Add(Document{DB: "room_configurations", ID: "Default-2", OldType: "room_configuration", OldID: 1})
+
+	srv := httptest.NewServer(crosswalkHandler(c))
+	defer srv.Close()
+
+	tests := []struct {
+		path   string
+		status int
+		ids    []string
+	}{
+		{"/crosswalk/room/1", http.StatusOK, []string{"ITB-1101"}},
+		{"/crosswalk/room_configuration/1", http.StatusOK, []string{"Default", "Default-2"}},
+		{"/crosswalk/room/2", http.StatusNotFound, nil},
+		{"/crosswalk/device/1", http.StatusNotFound, nil},
+		{"/crosswalk/room/abc", http.StatusBadRequest, nil},
+		{"/crosswalk/room", http.StatusBadRequest, nil},
+	}
+
+	for _, tt := range tests {
+		resp, err := http.Get(srv.URL + tt.path)
+		if err != nil {
+			t.Fatalf("%v : %v", tt.path, err)
+		}
+
+		var entries []CrosswalkEntry
+		if resp.StatusCode == http.StatusOK {
+			json.NewDecoder(resp.Body).Decode(&entries)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%v: status %v, want %v", tt.path, resp.StatusCode, tt.status)
+			continue
+		}
+
+		var ids []string
+		for _, e := range entries {
+			ids = append(ids, e.ID)
+		}
+
+		if !reflect.DeepEqual(ids, tt.ids) {
+			t.Errorf("%v: ids = %v, want %v", tt.path, ids, tt.ids)
+		}
+	}
+}
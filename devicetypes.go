@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	newstructs "github.com/byuoitav/common/structs"
+)
+
+// deviceTypeBuilder merges what every device of a class says about that class into a single device type,
+// so the result doesn't depend on which device happened to be processed last.
+type deviceTypeBuilder struct {
+	mu      sync.Mutex
+	classes map[string]*classInfo
+	failed  map[string]error // classes whose device types couldn't be mapped
+}
+
+// classInfo is everything the devices of one class said about it.
+type classInfo struct {
+	base newstructs.DeviceType
+
+	// which devices said the class is an input/output (true) or not (false)
+	input  map[bool][]string
+	output map[bool][]string
+
+	// each version of each command (by id), and which devices had that version
+	commands map[string]map[string]*commandVersion
+}
+
+type commandVersion struct {
+	command newstructs.Command
+	devices []string
+}
+
+func newDeviceTypeBuilder() *deviceTypeBuilder {
+	return &deviceTypeBuilder{
+		classes: make(map[string]*classInfo),
+		failed:  make(map[string]error),
+	}
+}
+
+// Add records the device type built from a single device.
+func (b *deviceTypeBuilder) Add(device string, dt newstructs.DeviceType) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info, ok := b.classes[dt.ID]
+	if !ok {
+		info = &classInfo{
+			base: newstructs.DeviceType{
+				ID:          dt.ID,
+				Description: dt.Description,
+				Ports:       dt.Ports,
+			},
+			input:    make(map[bool][]string),
+			output:   make(map[bool][]string),
+			commands: make(map[string]map[string]*commandVersion),
+		}
+		b.classes[dt.ID] = info
+	}
+
+	info.input[dt.Input] = append(info.input[dt.Input], device)
+	info.output[dt.Output] = append(info.output[dt.Output], device)
+
+	for _, c := range dt.Commands {
+		key, _ := json.Marshal(c)
+
+		versions, ok := info.commands[c.ID]
+		if !ok {
+			versions = make(map[string]*commandVersion)
+			info.commands[c.ID] = versions
+		}
+
+		v, ok := versions[string(key)]
+		if !ok {
+			v = &commandVersion{command: c}
+			versions[string(key)] = v
+		}
+
+		v.devices = append(v.devices, device)
+	}
+}
+
+// Fail records that a device's type couldn't be mapped, so class is reported as failed instead of built without it.
+func (b *deviceTypeBuilder) Fail(class string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.failed[class]; !ok {
+		b.failed[class] = err
+	}
+}
+
+// Failed is why class can't be built, or nil if it can.
+func (b *deviceTypeBuilder) Failed(class string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.failed[class]
+}
+
+// Classes returns the id of every class seen, sorted.
+func (b *deviceTypeBuilder) Classes() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	var ids []string
+	for id := range b.classes {
+		ids = append(ids, id)
+	}
+	for id := range b.failed {
+		if _, ok := b.classes[id]; !ok {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// Build merges everything recorded for class into one device type. A class is an input or output
+// if any of its devices are, and a command's microservice, endpoint and priority come from whichever
+// version of it the most devices have, preferring versions whose microservice and endpoint both resolved.
+// conflicts describes every place the devices disagreed.
+func (b *deviceTypeBuilder) Build(class string) (dt newstructs.DeviceType, conflicts []string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	info := b.classes[class]
+	dt = info.base
+
+	dt.Input = len(info.input[true]) > 0
+	dt.Output = len(info.output[true]) > 0
+
+	if len(info.input) > 1 {
+		conflicts = append(conflicts, fmt.Sprintf("device type %v: input on %v, not on %v", class, sample(info.input[true]), sample(info.input[false])))
+	}
+	if len(info.output) > 1 {
+		conflicts = append(conflicts, fmt.Sprintf("device type %v: output on %v, not on %v", class, sample(info.output[true]), sample(info.output[false])))
+	}
+
+	var ids []string
+	for id := range info.commands {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		var versions []*commandVersion
+		for _, v := range info.commands[id] {
+			versions = append(versions, v)
+		}
+
+		// versions whose microservice and endpoint both resolved first, then the most common, with ties
+		// broken by the rest of the command so the result is always the same
+		sort.Slice(versions, func(i, j int) bool {
+			a, b := versions[i].command, versions[j].command
+			switch {
+			case resolved(a) != resolved(b):
+				return resolved(a)
+			case len(versions[i].devices) != len(versions[j].devices):
+				return len(versions[i].devices) > len(versions[j].devices)
+			case a.Microservice.ID != b.Microservice.ID:
+				return a.Microservice.ID < b.Microservice.ID
+			case a.Endpoint.ID != b.Endpoint.ID:
+				return a.Endpoint.ID < b.Endpoint.ID
+			case a.Microservice.Address != b.Microservice.Address:
+				return a.Microservice.Address < b.Microservice.Address
+			case a.Endpoint.Path != b.Endpoint.Path:
+				return a.Endpoint.Path < b.Endpoint.Path
+			default:
+				return a.Priority < b.Priority
+			}
+		})
+
+		dt.Commands = append(dt.Commands, versions[0].command)
+
+		if len(versions) > 1 {
+			var described []string
+			for _, v := range versions {
+				described = append(described, fmt.Sprintf("%v %v priority %v on %v", v.command.Microservice.ID, v.command.Endpoint.Path, v.command.Priority, sample(v.devices)))
+			}
+
+			conflicts = append(conflicts, fmt.Sprintf("device type %v: command %v differs between devices (%v), using the first", class, id, strings.Join(described, "; ")))
+		}
+	}
+
+	return dt, conflicts
+}
+
+// resolved is true if both the microservice and endpoint of c were found in the old configuration database.
+func resolved(c newstructs.Command) bool {
+	return len(c.Microservice.ID) > 0 && len(c.Endpoint.ID) > 0
+}
+
+// sample lists a few of devices, to keep conflict messages readable.
+func sample(devices []string) string {
+	sorted := append([]string(nil), devices...)
+	sort.Strings(sorted)
+
+	if len(sorted) > 3 {
+		return fmt.Sprintf("%v and %v others", strings.Join(sorted[:3], ", "), len(sorted)-3)
+	}
+
+	return strings.Join(sorted, ", ")
+}
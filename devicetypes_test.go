@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	newstructs "github.com/byuoitav/common/structs"
+)
+
+var errTest = errors.New("test")
+
+func TestDeviceTypeBuild(t *testing.T) {
+	command := func(id, microservice, path string) newstructs.Command {
+		return newstructs.Command{
+			ID:           id,
+			Microservice: newstructs.Microservice{ID: microservice},
+			Endpoint:     newstructs.Endpoint{ID: path, Path: path},
+		}
+	}
+
+	on := command("PowerOn", "sony", "/on")
+	onPi := command("PowerOn", "pi", "/on")
+	off := command("PowerOff", "sony", "/off")
+	onUnresolved := command("PowerOn", "", "/on")
+
+	onSony := func(address string) newstructs.Command {
+		c := command("PowerOn", "sony", "/on")
+		c.Microservice.Address = address
+		return c
+	}
+
+	type device struct {
+		name string
+		dt   newstructs.DeviceType
+	}
+
+	tests := []struct {
+		name      string
+		devices   []device
+		want      newstructs.DeviceType
+		conflicts []string // a part of each conflict, in order
+	}{
+		{
+			"one device",
+			[]device{{"ITB-1101-D1", newstructs.DeviceType{ID: "TV", Output: true, Commands: []newstructs.Command{on}}}},
+			newstructs.DeviceType{ID: "TV", Output: true, Commands: []newstructs.Command{on}},
+			nil,
+		},
+		{
+			"commands from every device",
+			[]device{
+				{"ITB-1101-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{on}}},
+				{"ITB-1102-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{off}}},
+			},
+			newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{off, on}},
+			nil,
+		},
+		{
+			"output if any device is",
+			[]device{
+				{"ITB-1101-D1", newstructs.DeviceType{ID: "TV", Output: true}},
+				{"ITB-1102-D1", newstructs.DeviceType{ID: "TV"}},
+			},
+			newstructs.DeviceType{ID: "TV", Output: true},
+			[]string{"output on ITB-1101-D1, not on ITB-1102-D1"},
+		},
+		{
+			"most common command wins",
+			[]device{
+				{"ITB-1101-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{onPi}}},
+				{"ITB-1102-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{on}}},
+				{"ITB-1103-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{on}}},
+			},
+			newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{on}},
+			[]string{"command PowerOn differs"},
+		},
+		{
+			"ties go to the first microservice",
+			[]device{
+				{"ITB-1101-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{on}}},
+				{"ITB-1102-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{onPi}}},
+			},
+			newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{onPi}},
+			[]string{"command PowerOn differs"},
+		},
+		{
+			"resolved beats more common",
+			[]device{
+				{"ITB-1101-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{onUnresolved}}},
+				{"ITB-1102-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{onUnresolved}}},
+				{"ITB-1103-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{on}}},
+			},
+			newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{on}},
+			[]string{"command PowerOn differs"},
+		},
+		{
+			"ties go to the first address",
+			[]device{
+				{"ITB-1101-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{onSony("sony-b:8007")}}},
+				{"ITB-1102-D1", newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{onSony("sony-a:8007")}}},
+			},
+			newstructs.DeviceType{ID: "TV", Commands: []newstructs.Command{onSony("sony-a:8007")}},
+			[]string{"command PowerOn differs"},
+		},
+		{
+			"description from the first device",
+			[]device{
+				{"ITB-1101-D1", newstructs.DeviceType{ID: "TV", Description: "Sony TV"}},
+				{"ITB-1102-D1", newstructs.DeviceType{ID: "TV", Description: "other"}},
+			},
+			newstructs.DeviceType{ID: "TV", Description: "Sony TV"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		b := newDeviceTypeBuilder()
+		for _, d := range tt.devices {
+			b.Add(d.name, d.dt)
+		}
+
+		dt, conflicts := b.Build("TV")
+
+		if !reflect.DeepEqual(dt, tt.want) {
+			t.Errorf("%v: Build = %+v, want %+v", tt.name, dt, tt.want)
+		}
+
+		if len(conflicts) != len(tt.conflicts) {
+			t.Errorf("%v: conflicts = %q, want %v of them", tt.name, conflicts, len(tt.conflicts))
+			continue
+		}
+
+		for i := range conflicts {
+			if !strings.Contains(conflicts[i], tt.conflicts[i]) {
+				t.Errorf("%v: conflict %q, want it to mention %q", tt.name, conflicts[i], tt.conflicts[i])
+			}
+		}
+	}
+}
+
+func TestDeviceTypeClasses(t *testing.T) {
+	b := newDeviceTypeBuilder()
+	b.Add("ITB-1101-D1", newstructs.DeviceType{ID: "TV"})
+	b.Add("ITB-1101-CP1", newstructs.DeviceType{ID: "Pi3"})
+	b.Fail("Pi3", errTest)
+	b.Fail("Camera", errTest)
+
+	if classes := b.Classes(); !reflect.DeepEqual(classes, []string{"Camera", "Pi3", "TV"}) {
+		t.Errorf("Classes = %v, want Camera, Pi3 and TV", classes)
+	}
+
+	if b.Failed("TV") != nil || b.Failed("Pi3") != errTest {
+		t.Errorf("Failed(TV) = %v, Failed(Pi3) = %v, want only Pi3 failed", b.Failed("TV"), b.Failed("Pi3"))
+	}
+}
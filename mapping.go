@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/byuoitav/configuration-database-microservice/structs"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Mapping declares how records in the old configuration database become documents in the new one.
+// IDs and Fields are text/template strings; Rename tables swap old names (classes, roles, evaluators, ports) for new ones.
+type Mapping struct {
+	IDs    map[string]string `json:"ids" yaml:"ids"`
+	Fields map[string]string `json:"fields" yaml:"fields"`
+	Rename Renames           `json:"rename" yaml:"rename"`
+
+	templates map[string]*template.Template
+}
+
+// Renames are old name -> new name tables. Names that aren't listed are kept.
+type Renames struct {
+	Classes    map[string]string `json:"classes" yaml:"classes"`
+	Roles      map[string]string `json:"roles" yaml:"roles"`
+	Evaluators map[string]string `json:"evaluators" yaml:"evaluators"`
+	Ports      map[string]string `json:"ports" yaml:"ports"`
+}
+
+// the mapping used for anything a mapping file doesn't override.
+// .Old is always the old record, and every other value has already been renamed.
+var defaultIDs = map[string]string{
+	"building":           "{{.Building}}",
+	"room":               "{{.Building}}-{{.Room}}",
+	"room_configuration": "{{.Configuration}}",
+	"device":             "{{.Building}}-{{.Room}}-{{.Device}}",
+	"device_type":        "{{.Class}}",
+}
+
+var defaultFields = map[string]string{
+	"building.name":                  "{{.Old.Name}}",
+	"building.description":           "{{.Old.Description}}",
+	"room.description":               "{{.Old.Description}}",
+	"room_configuration.description": "{{.Old.RoomInitKey}}",
+	"evaluator.code_key":             "{{.Evaluator}}",
+	"evaluator.description":          "{{.Evaluator}}",
+	"device.name":                    "{{.Old.Name}}",
+	"device.description":             "{{.Old.DisplayName}}",
+	"device.display_name":            "{{.Old.DisplayName}}",
+	"device_type.description":        "{{.Old.Description}}",
+	"port.friendly_name":             "{{.Old.Description}}",
+	"port.description":               "{{.Old.Description}}",
+	"role.description":               "{{.Role}}",
+}
+
+// sampleValues are the values each template is given, with empty records, so a template that
+// refers to something that doesn't exist fails when the mapping is loaded rather than part way through a run.
+var sampleValues = map[string]map[string]interface{}{
+	"building":                       {"Building": "", "Old": structs.Building{}},
+	"room":                           {"Building": "", "Room": "", "Old": structs.Room{}},
+	"room_configuration":             {"Configuration": "", "Old": structs.RoomConfiguration{}},
+	"device":                         {"Building": "", "Room": "", "Device": "", "Class": "", "Old": structs.Device{}},
+	"device_type":                    {"Class": "", "Old": structs.DeviceClass{}},
+	"building.name":                  {"Building": "", "Old": structs.Building{}},
+	"building.description":           {"Building": "", "Old": structs.Building{}},
+	"room.description":               {"Building": "", "Room": "", "Old": structs.Room{}},
+	"room_configuration.description": {"Configuration": "", "Old": structs.RoomConfiguration{}},
+	"evaluator.code_key":             {"Evaluator": "", "Old": structs.Evaluator{}},
+	"evaluator.description":          {"Evaluator": "", "Old": structs.Evaluator{}},
+	"device.name":                    {"Building": "", "Room": "", "Device": "", "Class": "", "Old": structs.Device{}},
+	"device.description":             {"Building": "", "Room": "", "Device": "", "Class": "", "Old": structs.Device{}},
+	"device.display_name":            {"Building": "", "Room": "", "Device": "", "Class": "", "Old": structs.Device{}},
+	"device_type.description":        {"Class": "", "Old": structs.DeviceClass{}},
+	"port.friendly_name":             {"Port": "", "Old": structs.PortType{}},
+	"port.description":               {"Port": "", "Old": structs.PortType{}},
+	"role.description":               {"Role": "", "Old": ""},
+}
+
+// mapping is what the transformation uses, the defaults unless a mapping file is given.
+var mapping = mustMapping(newMapping())
+
+func newMapping() *Mapping {
+	return &Mapping{
+		IDs:    make(map[string]string),
+		Fields: make(map[string]string),
+	}
+}
+
+func mustMapping(m *Mapping) *Mapping {
+	if err := m.compile(); err != nil {
+		panic(err)
+	}
+
+	return m
+}
+
+// loadMapping reads a mapping file, YAML if it ends in .yaml or .yml and JSON otherwise.
+func loadMapping(path string) (*Mapping, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read mapping file : %v", err)
+	}
+
+	m := newMapping()
+
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = yaml.UnmarshalStrict(b, m)
+	default:
+		dec := json.NewDecoder(bytes.NewReader(b))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(m)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse mapping file %v : %v", path, err)
+	}
+
+	if err := m.compile(); err != nil {
+		return nil, fmt.Errorf("invalid mapping file %v : %v", path, err)
+	}
+
+	return m, nil
+}
+
+// compile fills in the defaults for anything m doesn't set, parses every template and tries each one out on empty records.
+func (m *Mapping) compile() error {
+	m.templates = make(map[string]*template.Template)
+
+	add := func(kind string, defaults, given map[string]string) error {
+		var unknown []string
+		for key := range given {
+			if _, ok := defaults[key]; !ok {
+				unknown = append(unknown, key)
+			}
+		}
+
+		if len(unknown) > 0 {
+			sort.Strings(unknown)
+			return fmt.Errorf("unknown %v %v", kind, strings.Join(unknown, ", "))
+		}
+
+		for key, text := range defaults {
+			if v, ok := given[key]; ok {
+				text = v
+			}
+
+			t, err := template.New(key).Option("missingkey=error").Parse(text)
+			if err != nil {
+				return fmt.Errorf("bad template for %v : %v", key, err)
+			}
+
+			if err := t.Execute(ioutil.Discard, sampleValues[key]); err != nil {
+				return fmt.Errorf("bad template for %v : %v", key, err)
+			}
+
+			m.templates[key] = t
+		}
+
+		return nil
+	}
+
+	if err := add("ids", defaultIDs, m.IDs); err != nil {
+		return err
+	}
+
+	return add("fields", defaultFields, m.Fields)
+}
+
+// ID builds the id of a document of kind (room, device...) from values. An empty id is an error,
+// since it would name the database instead of a document in it.
+func (m *Mapping) ID(kind string, values map[string]interface{}) (string, error) {
+	id, err := m.render(kind, values)
+	if err == nil && len(strings.TrimSpace(id)) == 0 {
+		err = fmt.Errorf("unable to map %v : the id is empty", kind)
+	}
+
+	return id, err
+}
+
+// Field builds the value of field (device.description...) from values.
+func (m *Mapping) Field(field string, values map[string]interface{}) (string, error) {
+	return m.render(field, values)
+}
+
+func (m *Mapping) render(key string, values map[string]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := m.templates[key].Execute(&buf, values); err != nil {
+		return "", fmt.Errorf("unable to map %v : %v", key, err)
+	}
+
+	return buf.String(), nil
+}
+
+// mapErrors keeps the first error from mapping the parts of a document,
+// so the document can be built one field at a time and checked once.
+type mapErrors struct {
+	err error
+}
+
+// keep returns s, remembering err if it is the first.
+func (e *mapErrors) keep(s string, err error) string {
+	e.add(err)
+	return s
+}
+
+func (e *mapErrors) add(err error) {
+	if e.err == nil {
+		e.err = err
+	}
+}
+
+// the rename tables, which return name unchanged if it isn't listed
+
+func (m *Mapping) Class(name string) string {
+	return renamed(m.Rename.Classes, name)
+}
+
+func (m *Mapping) Role(name string) string {
+	return renamed(m.Rename.Roles, name)
+}
+
+func (m *Mapping) Evaluator(name string) string {
+	return renamed(m.Rename.Evaluators, name)
+}
+
+func (m *Mapping) Port(name string) string {
+	return renamed(m.Rename.Ports, name)
+}
+
+func renamed(table map[string]string, name string) string {
+	if v, ok := table[name]; ok {
+		return v
+	}
+
+	return name
+}
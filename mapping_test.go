@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/byuoitav/configuration-database-microservice/structs"
+)
+
+func TestMappingCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		ids     map[string]string
+		fields  map[string]string
+		wantErr string
+	}{
+		{"defaults", nil, nil, ""},
+		{"override", map[string]string{"room": "{{.Building}}_{{.Room}}"}, map[string]string{"device.description": "{{.Old.Name}}"}, ""},
+		{"guarded lookup", nil, map[string]string{"device.description": "{{if .Old.Roles}}{{index .Old.Roles 0}}{{end}}"}, ""},
+		{"unknown id", map[string]string{"floor": "{{.Building}}"}, nil, "unknown ids floor"},
+		{"unknown field", nil, map[string]string{"room.name": "{{.Room}}"}, "unknown fields room.name"},
+		{"bad syntax", map[string]string{"room": "{{.Building"}, nil, "bad template for room"},
+		{"missing value", map[string]string{"building": "{{.Room}}"}, nil, "bad template for building"},
+		{"missing field", nil, map[string]string{"room.description": "{{.Old.Notes}}"}, "bad template for room.description"},
+	}
+
+	for _, tt := range tests {
+		m := newMapping()
+		for k, v := range tt.ids {
+			m.IDs[k] = v
+		}
+		for k, v := range tt.fields {
+			m.Fields[k] = v
+		}
+
+		err := m.compile()
+		switch {
+		case len(tt.wantErr) == 0 && err != nil:
+			t.Errorf("%v: compile = %v, want no error", tt.name, err)
+		case len(tt.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%v: compile = %v, want %q", tt.name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMappingRender(t *testing.T) {
+	m := newMapping()
+	m.IDs["device"] = "{{.Building}}-{{.Room}}-{{.Device}}"
+	m.Fields["device.description"] = "{{index .Old.Roles 0}}"
+	if err := m.compile(); err == nil {
+		t.Fatalf("compile accepted an unguarded index")
+	}
+
+	m.Fields["device.description"] = "{{.Old.DisplayName}} ({{.Class}})"
+	if err := m.compile(); err != nil {
+		t.Fatalf("compile = %v", err)
+	}
+
+	device := map[string]interface{}{"Building": "ITB", "Room": "1101", "Device": "D1", "Class": "TV", "Old": structs.Device{DisplayName: "Display 1"}}
+
+	tests := []struct {
+		name    string
+		render  func() (string, error)
+		want    string
+		wantErr string
+	}{
+		{"id", func() (string, error) { return m.ID("device", device) }, "ITB-1101-D1", ""},
+		{"field", func() (string, error) { return m.Field("device.description", device) }, "Display 1 (TV)", ""},
+		{"empty id", func() (string, error) {
+			return m.ID("building", map[string]interface{}{"Building": " ", "Old": structs.Building{}})
+		}, "", "the id is empty"},
+		{"missing value", func() (string, error) {
+			return m.ID("device", map[string]interface{}{"Building": "ITB", "Old": structs.Device{}})
+		}, "", "unable to map device"},
+	}
+
+	for _, tt := range tests {
+		got, err := tt.render()
+		switch {
+		case len(tt.wantErr) == 0 && err != nil:
+			t.Errorf("%v: %v, want %q", tt.name, err, tt.want)
+		case len(tt.wantErr) == 0 && got != tt.want:
+			t.Errorf("%v: got %q, want %q", tt.name, got, tt.want)
+		case len(tt.wantErr) > 0 && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+			t.Errorf("%v: got %q, %v, want %q", tt.name, got, err, tt.wantErr)
+		}
+	}
+}
+
+func TestMapErrors(t *testing.T) {
+	var errs mapErrors
+
+	if s := errs.keep("a", nil); s != "a" || errs.err != nil {
+		t.Errorf("keep(a, nil) = %q, %v", s, errs.err)
+	}
+
+	errs.keep("", errTest)
+	errs.add(errors.New("later"))
+
+	if errs.err != errTest {
+		t.Errorf("err = %v, want the first error", errs.err)
+	}
+}
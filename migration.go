@@ -1,298 +1,835 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"net/http"
 	"os"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/byuoitav/configuration-database-microservice/structs"
 
-	"github.com/byuoitav/av-api/dbo"
 	"github.com/byuoitav/common/log"
 	newstructs "github.com/byuoitav/common/structs"
 )
 
 var buildingList []structs.Building
 var roomList []structs.Room
+var allRoomList []structs.Room // every room, including those outside the scope
 var configList []structs.RoomConfiguration
 var deviceClassList []structs.DeviceClass
 
 var typePortMap map[string][]structs.DeviceTypePort
 var commandNameMap map[string]structs.RawCommand
 
-var COUCH_ADDRESS string
-var COUCH_USERNAME string
-var COUCH_PASSWORD string
+// everything else from the old config db, keyed for lookups
+var shortnameMap map[int]string                     // building id -> shortname
+var configMap map[int]structs.RoomConfiguration     // configuration id -> configuration
+var deviceClassMap map[string]structs.DeviceClass   // class name -> class
+var portMap map[string]structs.PortType             // port name -> port
+var microserviceMap map[string]structs.Microservice // address -> microservice
+var endpointMap map[string]structs.Endpoint         // path -> endpoint
+var fullRoomMap map[string]structs.Room             // ITB-1101 -> GetRoomByInfo result
+
+// run is the state of a single command, set up from its options: where documents are read from and
+// written to, which part of the old database it covers, and the record of what happened.
+type run struct {
+	source     Source
+	sink       Sink
+	report     *Report
+	selected   *scope
+	checkpoint *Checkpoint
+	manifest   *Manifest
+	crosswalk  *Crosswalk
+
+	dbs         databases
+	parallelism int    // how many rooms (or buildings, configurations) are processed at once
+	divergent   string // what happens when rooms sharing a room configuration have different evaluators
+	variants    configVariants
+}
+
+// runMigrate reads everything from the old configuration database and writes it out
+// as the options describe.
+func runMigrate(o *options) {
+	r, phases := setup(o)
+	r.report.DryRun = o.dryRun
+
+	policy, err := parseExistingPolicy(o.onExisting)
+	if err != nil {
+		log.L.Fatalf("Invalid --on-existing : %v", err)
+	}
+
+	if len(o.crosswalkDoc) > 0 && strings.Count(o.crosswalkDoc, "/") != 1 {
+		log.L.Fatalf("Invalid --crosswalk-doc %q : must be <db>/<id>", o.crosswalkDoc)
+	}
+
+	switch o.validate {
+	case validateOff, validateWarn, validateBlock:
+	default:
+		log.L.Fatalf("Invalid --validate %q : must be off, warn or block", o.validate)
+	}
+
+	switch {
+	case o.dryRun:
+		// a plan doesn't write anything, so there's no progress to save
+		r.checkpoint = newCheckpoint("")
+	case o.resume:
+		r.checkpoint, err = loadCheckpoint(o.checkpointPath)
+		if err != nil {
+			log.L.Fatalf("Failed to resume : %v", err)
+		}
+
+		log.L.Infof("Resuming from %v (phase %v, last room %v, %v documents already written)", o.checkpointPath, r.checkpoint.Phase, r.checkpoint.LastRoom, len(r.checkpoint.Written))
+	default:
+		r.checkpoint = newCheckpoint(o.checkpointPath)
+	}
+
+	r.report.RunID = newRunID()
+
+	// there is nothing to roll back after a plan, and only couch keeps the revisions rollback needs
+	manifestDir := o.manifestDir
+	if o.dryRun || len(o.outputDir) > 0 {
+		manifestDir = ""
+	}
+	r.manifest = newManifest(manifestDir, r.report.RunID, o.address)
+	r.checkpoint.manifest = r.manifest
+	r.crosswalk = newCrosswalk(r.report.RunID)
+	r.crosswalk.Merge(r.checkpoint.Crosswalk)
+	r.checkpoint.crosswalk = r.crosswalk
+
+	log.L.Infof("Starting run %v", r.report.RunID)
+
+	ctx, cancel := runContext(o.deadline)
+	defer cancel()
+
+	var target getter
+	var couch *couchSink
+
+	// couch (and its credentials and certificates) is only set up when it is written to
+	if len(o.outputDir) > 0 {
+		files := &fileSink{dir: o.outputDir, policy: policy}
+		r.sink, target = files, files
+	} else {
+		couch = newCouchSink(ctx, o, policy)
+		r.sink, target = couch, couch
+
+		if o.batchSize > 0 {
+			r.sink = newBulkSink(couch, o.batchSize, r.report)
+		}
+	}
+
+	if o.dryRun {
+		r.sink = &planSink{target: target, out: os.Stdout}
+	}
 
-func main() {
+	if o.provenance {
+		origin := "configuration-database-microservice"
+		if len(o.snapshot) > 0 {
+			origin += " snapshot " + o.snapshot
+		}
+
+		r.sink = newProvenanceSink(r.sink, origin, r.report.RunID)
+	}
+
+	// only a run that writes to couch has anything to check there
+	if !o.skipPreflight && !o.dryRun && len(o.outputDir) == 0 {
+		if !r.preflight(ctx, o, couch, r.targetDBs(o, phases)) {
+			if !r.stopped(ctx) {
+				log.L.Errorf("Not migrating anything, preflight failed")
+			}
+
+			r.finish(o.reportPath)
+			return
+		}
+	}
+
+	r.loadSource(ctx, o, phases)
+	if r.stopped(ctx) {
+		r.finish(o.reportPath)
+		return
+	}
+
+	if o.validate == validateOff {
+		r.runPhases(ctx, phases)
+		if r.stopped(ctx) {
+			r.finish(o.reportPath)
+			return
+		}
+
+		r.saveCrosswalk(o, phases, target)
+		r.finish(o.reportPath)
+		return
+	}
+
+	// generate everything up front so the references between documents can be checked before any are written
+	out := r.sink
+	collected := newCollectSink()
+	r.sink = collected
+
+	phases = r.selectedOnly(phases)
+	for _, phase := range phases {
+		r.movePhase(ctx, phase)
+	}
+
+	if r.stopped(ctx) {
+		log.L.Errorf("Not writing anything, stopped before every document was generated")
+		r.finish(o.reportPath)
+		return
+	}
 
+	problems := validateReferences(collected, target, r.dbs)
+	for _, p := range problems {
+		if o.validate == validateBlock {
+			r.report.Errorf("Dangling reference: %v", p)
+		} else {
+			r.report.Warnf("Dangling reference: %v", p)
+		}
+	}
+
+	if o.validate == validateBlock && len(problems) > 0 {
+		log.L.Errorf("Not writing anything, found %v dangling references", len(problems))
+		r.finish(o.reportPath)
+		return
+	}
+
+	r.sink = out
+	r.replay(ctx, collected, phases)
+	if r.stopped(ctx) {
+		r.finish(o.reportPath)
+		return
+	}
+
+	r.saveCrosswalk(o, phases, target)
+	r.finish(o.reportPath)
+}
+
+// saveCrosswalk writes the crosswalk of the run to disk, and to couch (or wherever the run writes to) if asked.
+// A run that only covers part of the old database is merged into the crosswalk already there, and a plan writes nothing.
+func (r *run) saveCrosswalk(o *options, phases []string, target getter) {
+	if o.dryRun {
+		return
+	}
+
+	partial := r.selected.filtered() || len(r.selected.only) > 0 || len(phases) < len(allPhases)
+
+	if len(o.crosswalkPath) > 0 {
+		if partial {
+			if _, err := os.Stat(o.crosswalkPath + ".json"); err == nil {
+				older, err := loadCrosswalk(o.crosswalkPath + ".json")
+				if err != nil {
+					r.report.Errorf("Not saving crosswalk, unable to merge it with the one already there : %v", err)
+					return
+				}
+
+				r.crosswalk.Merge(older.Entries)
+			}
+		}
+
+		if err := r.crosswalk.Save(o.crosswalkPath); err != nil {
+			r.report.Errorf("Failed to save crosswalk : %v", err)
+		}
+	}
+
+	if len(o.crosswalkDoc) == 0 {
+		return
+	}
+
+	parts := strings.SplitN(o.crosswalkDoc, "/", 2)
+
+	if partial {
+		older, err := existingCrosswalk(target, parts[0], parts[1])
+		if err != nil {
+			r.report.Errorf("Not writing crosswalk to %v, unable to merge it with the one already there : %v", o.crosswalkDoc, err)
+			return
+		}
+
+		r.crosswalk.Merge(older)
+	}
+
+	r.record(r.sink.Put(r.crosswalk.Document(parts[0], parts[1]))...)
+	r.flush()
+
+	if err := r.manifest.Save(); err != nil {
+		log.L.Errorf("%v", err)
+	}
+}
+
+// existingCrosswalk is the entries of the crosswalk document already at db/id, if there is one.
+func existingCrosswalk(target getter, db, id string) ([]CrosswalkEntry, error) {
+	have, err := target.Get(db, id)
+	if err != nil || have == nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(have["entries"])
+	if err != nil {
+		return nil, fmt.Errorf("cannot marshal %v/%v : %v", db, id, err)
+	}
+
+	var entries []CrosswalkEntry
+	if err := json.Unmarshal(b, &entries); err != nil {
+		return nil, fmt.Errorf("unable to parse %v/%v : %v", db, id, err)
+	}
+
+	return entries, nil
+}
+
+// setup starts a run with the options shared by every command that runs the phases, and returns it with the phases to run.
+func setup(o *options) (*run, []string) {
+	if o.parallelism < 1 {
+		log.L.Fatalf("Invalid --parallelism %v : must be at least 1", o.parallelism)
+	}
+
+	r := &run{
+		report:      newReport(),
+		dbs:         o.dbs,
+		parallelism: o.parallelism,
+		divergent:   o.divergentEvaluators,
+	}
+
+	if r.divergent != divergentReport && r.divergent != divergentSplit {
+		log.L.Fatalf("Invalid --divergent-evaluators %q : must be report or split", o.divergentEvaluators)
+	}
+
+	if len(o.mappingPath) > 0 {
+		m, err := loadMapping(o.mappingPath)
+		if err != nil {
+			log.L.Fatalf("Failed to load mapping : %v", err)
+		}
+
+		mapping = m
+	}
+
+	phases, err := o.selectedPhases()
+	if err != nil {
+		log.L.Fatalf("Invalid --phases : %v", err)
+	}
+
+	r.selected, err = newScope(o.building, o.room, o.designation, o.only, o.dbs)
+	if err != nil {
+		log.L.Fatalf("Invalid scope : %v", err)
+	}
+
+	// nothing is saved unless the command sets these up itself
+	r.checkpoint = newCheckpoint("")
+	r.manifest = newManifest("", "", o.address)
+	r.crosswalk = newCrosswalk("")
+	r.checkpoint.manifest = r.manifest
+
+	return r, phases
+}
+
+// loadSource reads everything phases work from out of the old configuration database.
+func (r *run) loadSource(ctx context.Context, o *options, phases []string) {
 	var err error
 
-	buildingList, err = dbo.GetBuildings()
+	r.source = dboSource{timeout: o.timeout}
+	if len(o.snapshot) > 0 {
+		r.source, err = newSnapshotSource(o.snapshot)
+		if err != nil {
+			log.L.Fatalf("Failed to load source snapshot : %v", err)
+		}
+	}
+
+	buildingList, err = r.source.GetBuildings(ctx)
 	if err != nil {
-		log.L.Errorf("Failed to get info from old config db : %v", err)
+		r.report.Errorf("Failed to get info from old config db : %v", err)
 	}
-	roomList, err = dbo.GetRooms()
+	roomList, err = r.source.GetRooms(ctx)
 	if err != nil {
-		log.L.Errorf("Failed to get info from old config db : %v", err)
+		r.report.Errorf("Failed to get info from old config db : %v", err)
 	}
-	configList, err = dbo.GetRoomConfigurations()
+	configList, err = r.source.GetRoomConfigurations(ctx)
 	if err != nil {
-		log.L.Errorf("Failed to get info from old config db : %v", err)
+		r.report.Errorf("Failed to get info from old config db : %v", err)
 	}
-	deviceClassList, err = dbo.GetDeviceClasses()
+	deviceClassList, err = r.source.GetDeviceClasses(ctx)
 	if err != nil {
-		log.L.Errorf("Failed to get info from old config db : %v", err)
+		r.report.Errorf("Failed to get info from old config db : %v", err)
 	}
-	allCommands, err := dbo.GetAllRawCommands()
+	allCommands, err := r.source.GetAllRawCommands(ctx)
 	if err != nil {
-		log.L.Errorf("Failed to get info from old config db : %v", err)
+		r.report.Errorf("Failed to get info from old config db : %v", err)
+	}
+
+	// rooms outside the scope can still be read, so every building's shortname is kept
+	shortnameMap = make(map[int]string)
+	for _, b := range buildingList {
+		shortnameMap[b.ID] = b.Shortname
 	}
 
-	COUCH_ADDRESS = os.Getenv("DB_ADDRESS")
-	COUCH_USERNAME = os.Getenv("DB_USERNAME")
-	COUCH_PASSWORD = os.Getenv("DB_PASSWORD")
+	allRoomList = roomList
+	for _, problem := range r.selected.apply() {
+		r.report.Errorf("Invalid scope : %v", problem)
+	}
+	log.L.Infof("Migrating %v buildings, %v rooms and %v room configurations", len(buildingList), len(roomList), len(configList))
 
 	typePortMap = make(map[string][]structs.DeviceTypePort)
 
 	for _, t := range deviceClassList {
-		typePortMap[t.Name], err = dbo.GetPortsByClass(t.Name)
+		typePortMap[t.Name], err = r.source.GetPortsByClass(ctx, t.Name)
 		if err != nil {
-			log.L.Errorf("Failed to get info from old config db : %v", err)
+			r.report.Errorf("Failed to get info from old config db : %v", err)
 		}
 	}
 
-	// log.L.Infof("%s", typePortMap)
-
 	commandNameMap = make(map[string]structs.RawCommand)
 
 	for _, c := range allCommands {
 		commandNameMap[c.Name] = c
 	}
 
-	moveBuildings()
-	moveRooms()
-	moveRoomConfigurations()
-	moveDevicesAndTypes()
+	configMap = make(map[int]structs.RoomConfiguration)
+	for _, c := range configList {
+		configMap[c.ID] = c
+	}
+
+	deviceClassMap = make(map[string]structs.DeviceClass)
+	for _, t := range deviceClassList {
+		deviceClassMap[t.Name] = t
+	}
+
+	needs := make(map[string]bool)
+	for _, phase := range phases {
+		needs[phase] = true
+	}
+
+	if needs["devices"] {
+		r.loadDeviceInfo(ctx)
+	}
+
+	// rooms only need their full details when split configurations change which one they use
+	if needs["room_configurations"] || needs["devices"] || (needs["rooms"] && r.divergent == divergentSplit) {
+		r.prefetchRooms(ctx, r.roomsToRead(needs))
+	}
 }
 
-func moveBuildings() {
-	log.L.Info("Starting moveBuildings...")
+// roomsToRead returns the rooms whose full details are needed: the selected rooms, and every other room
+// sharing a configuration with them, since a configuration's evaluators (and, when split, which variant
+// each room uses) depend on all of its rooms. Device types are built from every device of their class,
+// so every room is read when they are written.
+func (r *run) roomsToRead(needs map[string]bool) []structs.Room {
+	if !r.selected.filtered() {
+		return roomList
+	}
 
-	for i := range buildingList {
+	// nothing was selected, so there is nothing to build from them
+	if len(roomList) == 0 {
+		return nil
+	}
 
-		bldg := newstructs.Building{}
+	if needs["devices"] && r.selected.writes(r.dbs.deviceTypes) {
+		return allRoomList
+	}
 
-		bldg.ID = buildingList[i].Shortname
-		bldg.Name = buildingList[i].Name
-		bldg.Description = buildingList[i].Description
+	inScope := make(map[string]bool)
+	for _, room := range roomList {
+		inScope[roomKey(room)] = true
+	}
 
-		url := fmt.Sprintf("%v/buildings/%v", COUCH_ADDRESS, bldg.ID)
+	var rooms []structs.Room
+	for _, room := range allRoomList {
+		if _, ok := configMap[room.ConfigurationID]; ok || inScope[roomKey(room)] {
+			rooms = append(rooms, room)
+		}
+	}
 
-		body, err := json.Marshal(bldg)
-		if err != nil {
-			log.L.Errorf("Cannot marshal building : %v", err)
-			return
+	return rooms
+}
+
+// loadDeviceInfo reads the ports, microservices and endpoints that devices and their types refer to.
+func (r *run) loadDeviceInfo(ctx context.Context) {
+	ports, err := r.source.GetPorts(ctx)
+	if err != nil {
+		r.report.Errorf("Failed to get info from old config db : %v", err)
+	}
+	microservices, err := r.source.GetMicroservices(ctx)
+	if err != nil {
+		r.report.Errorf("Failed to get info from old config db : %v", err)
+	}
+	endpoints, err := r.source.GetEndpoints(ctx)
+	if err != nil {
+		r.report.Errorf("Failed to get info from old config db : %v", err)
+	}
+
+	portMap = make(map[string]structs.PortType)
+	for _, p := range ports {
+		if _, ok := portMap[p.Name]; !ok {
+			portMap[p.Name] = p
 		}
+	}
 
-		req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
-		if err != nil {
-			log.L.Errorf("Error making request : %v", err)
-			return
+	microserviceMap = make(map[string]structs.Microservice)
+	for _, m := range microservices {
+		if _, ok := microserviceMap[m.Address]; !ok {
+			microserviceMap[m.Address] = m
 		}
+	}
 
-		// add auth
-		if len(COUCH_USERNAME) > 0 && len(COUCH_PASSWORD) > 0 {
-			req.SetBasicAuth(COUCH_USERNAME, COUCH_PASSWORD)
+	endpointMap = make(map[string]structs.Endpoint)
+	for _, e := range endpoints {
+		if _, ok := endpointMap[e.Path]; !ok {
+			endpointMap[e.Path] = e
 		}
+	}
+}
+
+// prefetchRooms reads the full details of every room once, so no phase has to ask for them again.
+// Rooms that can't be read are reported here and left out of every phase that needs them.
+func (r *run) prefetchRooms(ctx context.Context, rooms []structs.Room) {
+	log.L.Infof("Reading %v rooms from the old config db", len(rooms))
+
+	fullRoomMap = make(map[string]structs.Room)
 
-		client := &http.Client{}
+	var mu sync.Mutex
+	forEach(ctx, r.parallelism, len(rooms), func(i int) {
+		room := rooms[i]
 
-		resp, err := client.Do(req)
+		fullRoom, err := r.source.GetRoomByInfo(ctx, shortnameMap[room.Building.ID], room.Name)
 		if err != nil {
-			log.L.Errorf("Error doing request : %v", err)
+			r.report.Errorf("Failed to get room %v from old config db : %v", roomKey(room), err)
 			return
 		}
 
-		resp.Body.Close()
-	}
+		mu.Lock()
+		fullRoomMap[roomKey(room)] = fullRoom
+		mu.Unlock()
+	})
 }
 
-func moveRooms() {
-	log.L.Info("Starting moveRooms...")
+// roomKey identifies r by building shortname and name (ITB-1101).
+func roomKey(r structs.Room) string {
+	return fmt.Sprintf("%s-%s", shortnameMap[r.Building.ID], r.Name)
+}
 
-	for _, r := range roomList {
+// runPhases runs each of phases in order, handing every document to the sink.
+func (r *run) runPhases(ctx context.Context, phases []string) {
+	// each phase finishes before the next starts, so rooms only ever reference
+	// configurations that have been written, and devices only rooms that have
+	for _, phase := range r.selectedOnly(phases) {
+		r.checkpoint.StartPhase(phase)
+		r.movePhase(ctx, phase)
+
+		// a phase that was stopped part way through is left for --resume to finish
+		if ctx.Err() != nil {
+			r.checkpoint.save()
+			if err := r.manifest.Save(); err != nil {
+				log.L.Errorf("%v", err)
+			}
 
-		room := newstructs.Room{}
-		config := newstructs.RoomConfiguration{}
+			return
+		}
 
-		bldgName := ""
+		r.checkpoint.FinishPhase(phase)
 
-		for a := 0; a < len(buildingList); a++ {
-			if r.Building.ID == buildingList[a].ID {
-				bldgName = buildingList[a].Shortname
-			}
+		if err := r.manifest.Save(); err != nil {
+			log.L.Errorf("%v", err)
 		}
+	}
+}
 
-		configName := ""
+// selectedOnly leaves out the phases that don't write to any of the databases picked with --only,
+// and those the run being resumed already finished.
+func (r *run) selectedOnly(phases []string) []string {
+	var needed []string
 
-		for b := 0; b < len(configList); b++ {
-			if r.ConfigurationID == configList[b].ID {
-				configName = configList[b].Name
+	for _, phase := range phases {
+		if r.checkpoint.Finished(phase) {
+			log.L.Infof("Skipping phase %v, it was finished by the run being resumed", phase)
+			continue
+		}
+
+		for _, db := range r.phaseWrites(phase) {
+			if r.selected.writes(db) {
+				needed = append(needed, phase)
+				break
 			}
 		}
 
-		room.ID = fmt.Sprintf("%s-%s", bldgName, r.Name)
-		room.Description = r.Description
-		config.ID = configName
-		room.Configuration = config
-		room.Designation = r.RoomDesignation
+		if len(needed) == 0 || needed[len(needed)-1] != phase {
+			log.L.Infof("Skipping phase %v, none of its databases were selected with --only", phase)
+		}
+	}
 
-		url := fmt.Sprintf("%v/rooms/%v", COUCH_ADDRESS, room.ID)
+	return needed
+}
 
-		body, err := json.Marshal(room)
-		if err != nil {
-			log.L.Errorf("Cannot marshal room : %v", err)
-			return
-		}
+func (r *run) movePhase(ctx context.Context, phase string) {
+	switch phase {
+	case "buildings":
+		r.moveBuildings(ctx)
+	case "room_configurations":
+		r.moveRoomConfigurations(ctx)
+	case "rooms":
+		r.moveRooms(ctx)
+	case "devices":
+		r.moveDevicesAndTypes(ctx)
+	}
+}
 
-		req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
-		if err != nil {
-			log.L.Errorf("Error making request : %v", err)
-			return
-		}
+// runRollback undoes the migrate run identified by runID.
+func runRollback(o *options, runID string) {
+	r := &run{report: newReport()}
+	r.report.RunID = runID
 
-		// add auth
-		if len(COUCH_USERNAME) > 0 && len(COUCH_PASSWORD) > 0 {
-			req.SetBasicAuth(COUCH_USERNAME, COUCH_PASSWORD)
-		}
+	m, err := loadManifest(o.manifestDir, runID)
+	if err != nil {
+		log.L.Fatalf("Failed to load run %v : %v", runID, err)
+	}
 
-		client := &http.Client{}
+	ctx, cancel := runContext(o.deadline)
+	defer cancel()
 
-		resp, err := client.Do(req)
-		if err != nil {
-			log.L.Errorf("Error doing request : %v", err)
-			return
-		}
+	couch := newCouchSink(ctx, o, overwriteExisting)
+	rollback(ctx, m, couch, r.report)
+	r.stopped(ctx)
 
-		resp.Body.Close()
+	r.finish(o.reportPath)
+}
+
+// phaseWrites returns the databases phase writes to.
+func (r *run) phaseWrites(phase string) []string {
+	switch phase {
+	case "buildings":
+		return []string{r.dbs.buildings}
+	case "room_configurations":
+		return []string{r.dbs.roomConfigurations}
+	case "rooms":
+		return []string{r.dbs.rooms}
+	case "devices":
+		return []string{r.dbs.devices, r.dbs.deviceTypes}
+	default:
+		return nil
 	}
 }
 
-func moveRoomConfigurations() {
-	log.L.Info("Starting moveRoomConfigurations...")
+// runExportSource saves everything the migration reads from the live old configuration database
+// into a snapshot at path, that can later be migrated from with --source-snapshot.
+func runExportSource(o *options, path string) {
+	if o.parallelism < 1 {
+		log.L.Fatalf("Invalid --parallelism %v : must be at least 1", o.parallelism)
+	}
 
-	for _, c := range configList {
+	r := &run{report: newReport(), parallelism: o.parallelism}
 
-		config := newstructs.RoomConfiguration{}
+	ctx, cancel := runContext(o.deadline)
+	defer cancel()
 
-		var evals []newstructs.Evaluator
+	snap := r.exportSnapshot(ctx, dboSource{timeout: o.timeout})
+	snap.ToolVersion = toolVersion()
 
-		for _, r := range roomList {
-			if r.ConfigurationID == c.ID {
-				bName := ""
-				for _, b := range buildingList {
-					if r.Building.ID == b.ID {
-						bName = b.Shortname
-						break
-					}
-				}
+	if r.stopped(ctx) || r.report.Failed() {
+		log.L.Errorf("Not writing %v, the old config db couldn't be read completely", path)
+		r.finish(o.reportPath)
+		return
+	}
 
-				fullRoom, _ := dbo.GetRoomByInfo(bName, r.Name)
+	if err := snap.Save(path); err != nil {
+		r.report.Errorf("%v", err)
+	} else {
+		log.L.Infof("Wrote %v buildings, %v rooms, %v room configurations and %v device classes to %v", len(snap.Buildings), len(snap.FullRooms), len(snap.RoomConfigurations), len(snap.DeviceClasses), path)
+	}
 
-				evals = make([]newstructs.Evaluator, len(fullRoom.Configuration.Evaluators))
+	r.finish(o.reportPath)
+}
 
-				for i, e := range fullRoom.Configuration.Evaluators {
-					evals[i].ID = e.EvaluatorKey
-					evals[i].CodeKey = e.EvaluatorKey
-					evals[i].Priority = e.Priority
-					evals[i].Description = e.EvaluatorKey
-				}
+// finish prints and saves the report, and exits non-zero if anything failed.
+func (r *run) finish(reportPath string) {
+	r.report.Finished = time.Now()
+	r.report.Print(os.Stdout)
 
-				break
-			}
-		}
+	if err := r.report.Save(reportPath); err != nil {
+		log.L.Errorf("%v", err)
+	}
+
+	if r.report.Failed() {
+		os.Exit(1)
+	}
+}
 
-		config.ID = c.Name
-		config.Description = c.RoomInitKey
-		config.Evaluators = evals
+func (r *run) moveBuildings(ctx context.Context) {
+	log.L.Info("Starting moveBuildings...")
 
-		log.L.Info(config)
+	forEach(ctx, r.parallelism, len(buildingList), func(i int) {
 
-		url := fmt.Sprintf("%v/room_configurations/%v", COUCH_ADDRESS, config.ID)
+		bldg := newstructs.Building{}
+		values := map[string]interface{}{"Building": buildingList[i].Shortname, "Old": buildingList[i]}
 
-		body, err := json.Marshal(config)
-		if err != nil {
-			log.L.Errorf("Cannot marshal room configuration : %v", err)
-			return
+		var errs mapErrors
+		bldg.ID = errs.keep(mapping.ID("building", values))
+		bldg.Name = errs.keep(mapping.Field("building.name", values))
+		bldg.Description = errs.keep(mapping.Field("building.description", values))
+
+		doc := Document{
+			DB:     r.dbs.buildings,
+			ID:     bldg.ID,
+			Origin: fmt.Sprintf("building %v", buildingList[i].ID),
+			Body:   bldg,
+
+			OldType: "building",
+			OldID:   buildingList[i].ID,
 		}
 
-		req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
-		if err != nil {
-			log.L.Errorf("Error making request : %v", err)
+		if errs.err != nil {
+			r.fail(doc, errs.err)
 			return
 		}
 
-		// add auth
-		if len(COUCH_USERNAME) > 0 && len(COUCH_PASSWORD) > 0 {
-			req.SetBasicAuth(COUCH_USERNAME, COUCH_PASSWORD)
+		r.put(doc)
+
+		r.checkpoint.BuildingDone(bldg.ID)
+	})
+
+	r.flush()
+}
+
+func (r *run) moveRooms(ctx context.Context) {
+	log.L.Info("Starting moveRooms...")
+
+	if r.divergent == divergentSplit {
+		r.roomConfigurationVariants()
+	}
+
+	forEach(ctx, r.parallelism, len(roomList), func(i int) {
+		old := roomList[i]
+
+		room := newstructs.Room{}
+		config := newstructs.RoomConfiguration{}
+
+		values := map[string]interface{}{"Building": shortnameMap[old.Building.ID], "Room": old.Name, "Old": old}
+
+		var errs mapErrors
+		room.ID = errs.keep(mapping.ID("room", values))
+		room.Description = errs.keep(mapping.Field("room.description", values))
+
+		if c, ok := configMap[old.ConfigurationID]; ok {
+			config.ID = errs.keep(roomConfigurationID(c))
 		}
 
-		client := &http.Client{}
+		// the room's evaluators may have put it in a configuration of its own, and a room
+		// can't be written if the configuration it uses can't be
+		if v, ok := r.variants.rooms[roomKey(old)]; ok {
+			config.ID = v.ID
+			if v.Err != nil {
+				errs.add(fmt.Errorf("its room configuration %v can't be written : %v", v.ID, v.Err))
+			}
+		}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			log.L.Errorf("Error doing request : %v", err)
+		room.Configuration = config
+		room.Designation = old.RoomDesignation
+
+		doc := Document{
+			DB:     r.dbs.rooms,
+			ID:     room.ID,
+			Origin: fmt.Sprintf("room %v", old.ID),
+			Body:   room,
+
+			OldType: "room",
+			OldID:   old.ID,
+		}
+
+		if errs.err != nil {
+			r.fail(doc, errs.err)
 			return
 		}
 
-		resp.Body.Close()
-	}
+		r.put(doc)
+	})
+
+	r.flush()
 }
 
-func moveDevicesAndTypes() {
-	log.L.Infof("Building list size: %v", len(buildingList))
-	log.L.Infof("Room list size: %v", len(roomList))
-	log.L.Infof("Config list size: %v", len(configList))
-	totalPortList, err := dbo.GetPorts()
-	microserviceList, err := dbo.GetMicroservices()
-	endpointList, err := dbo.GetEndpoints()
+func (r *run) moveRoomConfigurations(ctx context.Context) {
+	log.L.Info("Starting moveRoomConfigurations...")
 
-	if err != nil {
-		log.L.Errorf("Failed to get info from old config db : %v", err)
-	}
+	variants := r.roomConfigurationVariants()
 
-	for _, r := range roomList {
-		bName := ""
-		for _, b := range buildingList {
-			if r.Building.ID == b.ID {
-				bName = b.Shortname
-				break
+	forEach(ctx, r.parallelism, len(configList), func(i int) {
+		c := configList[i]
+
+		for _, v := range variants[c.ID] {
+			config := newstructs.RoomConfiguration{}
+
+			errs := mapErrors{err: v.Err}
+			config.ID = v.ID
+			config.Description = errs.keep(mapping.Field("room_configuration.description", map[string]interface{}{"Configuration": c.Name, "Old": c}))
+			config.Evaluators = v.Evaluators
+
+			log.L.Info(config)
+
+			doc := Document{
+				DB:     r.dbs.roomConfigurations,
+				ID:     config.ID,
+				Origin: fmt.Sprintf("room configuration %v", c.ID),
+				Body:   config,
+
+				OldType: "room_configuration",
+				OldID:   c.ID,
 			}
+
+			if errs.err != nil {
+				r.fail(doc, errs.err)
+				continue
+			}
+
+			r.put(doc)
+		}
+	})
+
+	r.flush()
+}
+
+func (r *run) moveDevicesAndTypes(ctx context.Context) {
+	log.L.Info("Starting moveDevicesAndTypes...")
+
+	// device types are built from every device of their class, so every room is read
+	// even when resuming; devices an earlier run wrote are skipped by put
+	types := newDeviceTypeBuilder()
+
+	forEach(ctx, r.parallelism, len(roomList), func(i int) {
+		room := roomList[i]
+		bName := shortnameMap[room.Building.ID]
+
+		fullRoom, ok := fullRoomMap[roomKey(room)]
+		if !ok {
+			// already reported when it couldn't be read
+			return
 		}
 
-		fullRoom, _ := dbo.GetRoomByInfo(bName, r.Name)
+		deviceID := func(name string) (string, error) {
+			values := map[string]interface{}{"Building": bName, "Room": room.Name, "Device": name, "Class": "", "Old": structs.Device{Name: name}}
+			for _, d := range fullRoom.Devices {
+				if d.Name == name {
+					values["Class"], values["Old"] = mapping.Class(d.Class), d
+					break
+				}
+			}
+
+			return mapping.ID("device", values)
+		}
 
 		for _, d := range fullRoom.Devices {
 			device := newstructs.Device{}
+			values := map[string]interface{}{"Building": bName, "Room": room.Name, "Device": d.Name, "Class": mapping.Class(d.Class), "Old": d}
 
-			device.ID = fmt.Sprintf("%v-%v-%v", fullRoom.Building.Shortname, fullRoom.Name, d.Name)
+			var errs mapErrors
+			device.ID = errs.keep(mapping.ID("device", values))
 			device.Address = d.Address
-			device.Name = d.Name
-			device.Description = d.DisplayName
-			device.DisplayName = d.DisplayName
+			device.Name = errs.keep(mapping.Field("device.name", values))
+			device.Description = errs.keep(mapping.Field("device.description", values))
+			device.DisplayName = errs.keep(mapping.Field("device.display_name", values))
 
 			dType := newstructs.DeviceType{}
-			dType.ID = d.Class
+			dType.ID = errs.keep(deviceTypeID(d.Class))
 			device.Type = dType
 
 			roleList := make([]newstructs.Role, len(d.Roles))
 
 			for i, role := range d.Roles {
-				roleList[i].ID = role
-				roleList[i].Description = role
+				roleList[i].ID = mapping.Role(role)
+				roleList[i].Description = errs.keep(mapping.Field("role.description", map[string]interface{}{"Role": roleList[i].ID, "Old": role}))
 			}
 
 			device.Roles = roleList
@@ -300,138 +837,262 @@ func moveDevicesAndTypes() {
 			portList := make([]newstructs.Port, len(d.Ports))
 
 			for j, port := range d.Ports {
-				for _, p := range totalPortList {
-					if port.Name == p.Name {
-						portList[j].ID = p.Name
-						portList[j].FriendlyName = p.Description
-						portList[j].Description = p.Description
-						break
-					}
+				if p, ok := portMap[port.Name]; ok {
+					converted, err := convertPort(p)
+					errs.add(err)
+					portList[j] = converted
 				}
 
-				portList[j].SourceDevice = fmt.Sprintf("%s-%s-%s", bName, r.Name, port.Source)
-				portList[j].DestinationDevice = fmt.Sprintf("%s-%s-%s", bName, r.Name, port.Destination)
+				portList[j].SourceDevice = errs.keep(deviceID(port.Source))
+				portList[j].DestinationDevice = errs.keep(deviceID(port.Destination))
 			}
 
 			device.Ports = portList
 
 			// Creating/moving the DeviceTypes here as well...
-			deviceType := newstructs.DeviceType{}
+			deviceType, typeErr := newDeviceType(d)
 
-			for _, t := range deviceClassList {
-				if d.Class == t.Name {
-					deviceType.ID = t.Name
-					deviceType.Description = t.Description
-					deviceType.Input = d.Input
-					deviceType.Output = d.Output
+			doc := Document{
+				DB:     r.dbs.devices,
+				ID:     device.ID,
+				Origin: fmt.Sprintf("device %v", d.ID),
+				Body:   device,
 
-					typePortList := typePortMap[t.Name]
+				OldType: "device",
+				OldID:   d.ID,
+			}
 
-					ports := make([]newstructs.Port, len(typePortList))
+			if errs.err != nil {
+				r.fail(doc, errs.err)
+			} else {
+				r.put(doc)
+			}
 
-					for i, p := range typePortList {
-						ports[i].ID = p.Port.Name
-						ports[i].FriendlyName = p.Port.Description
-						ports[i].Description = p.Port.Description
-					}
+			switch {
+			case typeErr != nil && len(deviceType.ID) > 0:
+				types.Fail(deviceType.ID, typeErr)
+			case typeErr != nil:
+				// its id couldn't be mapped, which already failed the device
+			case len(deviceType.ID) == 0:
+				r.report.Warnf("Device %v has class %q, which isn't a known device class", device.ID, d.Class)
+			default:
+				types.Add(device.ID, deviceType)
+			}
+		}
 
-					deviceType.Ports = ports
+		r.checkpoint.RoomDone(roomKey(room))
+	})
 
-					commandList := make([]newstructs.Command, len(d.Commands))
+	// device types built from only some of the rooms would be missing commands, so leave them all for --resume
+	if ctx.Err() != nil {
+		r.flush()
+		return
+	}
 
-					for k, command := range d.Commands {
-						commandList[k].ID = command.Name
-						commandList[k].Description = command.Name
-						commandList[k].Priority = commandNameMap[command.Name].Priority
+	// for the same reason a scoped run builds them from the devices outside the scope too
+	if r.selected.filtered() {
+		addUnselectedDevices(types)
+	}
 
-						for _, m := range microserviceList {
-							if command.Microservice == m.Address {
-								micro := newstructs.Microservice{}
+	// the old id of the class each device type was made from
+	classIDs := make(map[string]int)
+	for _, t := range deviceClassList {
+		// classes whose ids can't be mapped have no device types to find
+		if id, err := deviceTypeID(t.Name); err == nil {
+			classIDs[id] = t.ID
+		}
+	}
 
-								micro.ID = m.Name
-								micro.Address = m.Address
-								micro.Description = m.Description
+	for _, class := range types.Classes() {
+		if err := types.Failed(class); err != nil {
+			r.fail(Document{DB: r.dbs.deviceTypes, ID: class, Origin: fmt.Sprintf("device class %v", class)}, err)
+			continue
+		}
 
-								commandList[k].Microservice = micro
-								break
-							}
-						}
+		deviceType, conflicts := types.Build(class)
+		for _, c := range conflicts {
+			r.report.Warnf("Conflicting devices: %v", c)
+		}
 
-						for _, e := range endpointList {
-							if command.Endpoint.Path == e.Path {
-								end := newstructs.Endpoint{}
+		doc := Document{
+			DB:     r.dbs.deviceTypes,
+			ID:     deviceType.ID,
+			Origin: fmt.Sprintf("device class %v", class),
+			Body:   deviceType,
+		}
 
-								end.ID = e.Name
-								end.Path = e.Path
-								end.Description = e.Description
+		if id, ok := classIDs[class]; ok {
+			doc.OldType, doc.OldID = "device_class", id
+		}
 
-								commandList[k].Endpoint = end
-								break
-							}
-						}
-					}
+		r.put(doc)
+	}
 
-					deviceType.Commands = commandList
-				}
-			}
+	r.flush()
+}
 
-			// // Send the Device to Couch
-			url := fmt.Sprintf("%s/devices/%s", COUCH_ADDRESS, device.ID)
+// newDeviceType is the device type d says its class is.
+func newDeviceType(d structs.Device) (newstructs.DeviceType, error) {
+	deviceType := newstructs.DeviceType{}
 
-			body, err := json.Marshal(device)
-			if err != nil {
-				log.L.Errorf("Cannot marshal device : %v", err)
-				return
-			}
+	var errs mapErrors
+	if t, ok := deviceClassMap[d.Class]; ok {
+		deviceType.ID = errs.keep(deviceTypeID(t.Name))
+		deviceType.Description = errs.keep(mapping.Field("device_type.description", map[string]interface{}{"Class": mapping.Class(t.Name), "Old": t}))
+		deviceType.Input = d.Input
+		deviceType.Output = d.Output
 
-			req, err := http.NewRequest("PUT", url, bytes.NewReader(body))
-			if err != nil {
-				log.L.Errorf("Error making request : %v", err)
-				return
-			}
+		typePortList := typePortMap[t.Name]
 
-			// add auth
-			if len(COUCH_USERNAME) > 0 && len(COUCH_PASSWORD) > 0 {
-				req.SetBasicAuth(COUCH_USERNAME, COUCH_PASSWORD)
-			}
+		ports := make([]newstructs.Port, len(typePortList))
 
-			client := &http.Client{}
+		for i, p := range typePortList {
+			port, err := convertPort(p.Port)
+			errs.add(err)
+			ports[i] = port
+		}
 
-			resp, err := client.Do(req)
-			if err != nil {
-				log.L.Errorf("Error doing request : %v", err)
-				return
+		deviceType.Ports = ports
+
+		commandList := make([]newstructs.Command, len(d.Commands))
+
+		for k, command := range d.Commands {
+			commandList[k].ID = command.Name
+			commandList[k].Description = command.Name
+			commandList[k].Priority = commandNameMap[command.Name].Priority
+
+			if m, ok := microserviceMap[command.Microservice]; ok {
+				micro := newstructs.Microservice{}
+
+				micro.ID = m.Name
+				micro.Address = m.Address
+				micro.Description = m.Description
+
+				commandList[k].Microservice = micro
 			}
 
-			resp.Body.Close()
+			if e, ok := endpointMap[command.Endpoint.Path]; ok {
+				end := newstructs.Endpoint{}
 
-			// Send the DeviceType to Couch
-			url2 := fmt.Sprintf("%s/device_types/%s", COUCH_ADDRESS, deviceType.ID)
+				end.ID = e.Name
+				end.Path = e.Path
+				end.Description = e.Description
 
-			body2, err := json.Marshal(deviceType)
-			if err != nil {
-				log.L.Errorf("Cannot marshal device type : %v", err)
-				return
+				commandList[k].Endpoint = end
 			}
+		}
 
-			req2, err := http.NewRequest("PUT", url2, bytes.NewReader(body2))
-			if err != nil {
-				log.L.Errorf("Error making request : %v", err)
-				return
+		deviceType.Commands = commandList
+	}
+
+	return deviceType, errs.err
+}
+
+// addUnselectedDevices adds the devices in rooms outside the scope to the device types already in types.
+func addUnselectedDevices(types *deviceTypeBuilder) {
+	classes := make(map[string]bool)
+	for _, class := range types.Classes() {
+		classes[class] = true
+	}
+
+	inScope := make(map[string]bool)
+	for _, r := range roomList {
+		inScope[roomKey(r)] = true
+	}
+
+	for _, r := range allRoomList {
+		fullRoom, ok := fullRoomMap[roomKey(r)]
+		if inScope[roomKey(r)] || !ok {
+			continue
+		}
+
+		for _, d := range fullRoom.Devices {
+			deviceType, err := newDeviceType(d)
+			if !classes[deviceType.ID] {
+				continue
 			}
 
-			// add auth
-			if len(COUCH_USERNAME) > 0 && len(COUCH_PASSWORD) > 0 {
-				req2.SetBasicAuth(COUCH_USERNAME, COUCH_PASSWORD)
+			if err != nil {
+				types.Fail(deviceType.ID, err)
+				continue
 			}
 
-			resp2, err := client.Do(req2)
+			values := map[string]interface{}{"Building": shortnameMap[r.Building.ID], "Room": r.Name, "Device": d.Name, "Class": mapping.Class(d.Class), "Old": d}
+			id, err := mapping.ID("device", values)
 			if err != nil {
-				log.L.Errorf("Error doing request : %v", err)
-				return
+				types.Fail(deviceType.ID, err)
+				continue
 			}
 
-			resp2.Body.Close()
+			types.Add(id, deviceType)
 		}
 	}
 }
+
+// roomConfigurationID is the id of the new room configuration made from c.
+func roomConfigurationID(c structs.RoomConfiguration) (string, error) {
+	return mapping.ID("room_configuration", map[string]interface{}{"Configuration": c.Name, "Old": c})
+}
+
+// deviceTypeID is the id of the device type made from the device class named class.
+func deviceTypeID(class string) (string, error) {
+	t, ok := deviceClassMap[class]
+	if !ok {
+		t = structs.DeviceClass{Name: class}
+	}
+
+	values := map[string]interface{}{"Class": mapping.Class(class), "Old": t}
+
+	return mapping.ID("device_type", values)
+}
+
+func convertPort(p structs.PortType) (newstructs.Port, error) {
+	port := newstructs.Port{}
+	values := map[string]interface{}{"Port": mapping.Port(p.Name), "Old": p}
+
+	var errs mapErrors
+	port.ID = mapping.Port(p.Name)
+	port.FriendlyName = errs.keep(mapping.Field("port.friendly_name", values))
+	port.Description = errs.keep(mapping.Field("port.description", values))
+
+	return port, errs.err
+}
+
+// fail records that doc couldn't be built because of err, unless it is outside of the selected databases.
+func (r *run) fail(doc Document, err error) {
+	if !r.selected.writes(doc.DB) {
+		return
+	}
+
+	r.record(doc.failed(err))
+}
+
+// put writes doc unless it is outside of the selected databases or an earlier run already wrote it,
+// and records the outcome.
+func (r *run) put(doc Document) {
+	r.crosswalk.Add(doc)
+
+	if !r.selected.writes(doc.DB) {
+		return
+	}
+
+	if r.checkpoint.IsWritten(doc.DB, doc.ID) {
+		log.L.Debugf("Skipping %v/%v, it was written by an earlier run", doc.DB, doc.ID)
+		return
+	}
+
+	r.record(r.sink.Put(doc)...)
+}
+
+// flush writes anything the sink is still holding on to.
+func (r *run) flush() {
+	r.record(r.sink.Flush()...)
+}
+
+func (r *run) record(results ...Result) {
+	r.report.Add(results...)
+	r.checkpoint.Add(results...)
+	r.manifest.Add(results...)
+
+	r.checkpoint.saveEvery(checkpointInterval)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// planSink compares each document against what is already in the target and prints
+// whether it would be created, updated or left unchanged, without writing anything.
+type planSink struct {
+	target getter
+	out    io.Writer
+
+	// mu keeps the lines for one document together
+	mu sync.Mutex
+}
+
+func (p *planSink) Put(doc Document) []Result {
+	return []Result{p.plan(doc)}
+}
+
+// Flush does nothing, nothing is ever written.
+func (p *planSink) Flush() []Result {
+	return nil
+}
+
+func (p *planSink) plan(doc Document) Result {
+	want, err := toMap(doc.Body)
+	if err != nil {
+		return doc.failed(fmt.Errorf("cannot marshal %v/%v : %v", doc.DB, doc.ID, err))
+	}
+
+	have, err := p.target.Get(doc.DB, doc.ID)
+	if err != nil {
+		return doc.failed(err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if have == nil {
+		fmt.Fprintf(p.out, "create    %v/%v\n", doc.DB, doc.ID)
+		return doc.result(actionCreated)
+	}
+
+	changes := diffDocs(have, want)
+	if len(changes) == 0 {
+		fmt.Fprintf(p.out, "unchanged %v/%v\n", doc.DB, doc.ID)
+		return doc.result(actionUnchanged)
+	}
+
+	fmt.Fprintf(p.out, "update    %v/%v\n", doc.DB, doc.ID)
+	for _, c := range changes {
+		fmt.Fprintf(p.out, "    %v\n", c)
+	}
+
+	return doc.result(actionUpdated)
+}
+
+// diffDocs returns a line for every field that differs between have and want,
+// ignoring couch's _id and _rev.
+func diffDocs(have, want map[string]interface{}) []string {
+	a := make(map[string]interface{})
+	b := make(map[string]interface{})
+
+	// provenance only says when a document was last migrated, so it isn't a change unless it's missing
+	_, stamped := have[provenanceField]
+
+	for k, v := range have {
+		if k == "_id" || k == "_rev" || k == provenanceField {
+			continue
+		}
+		flatten(k, v, a)
+	}
+	for k, v := range want {
+		if k == "_id" || k == "_rev" || (k == provenanceField && stamped) {
+			continue
+		}
+		flatten(k, v, b)
+	}
+
+	var changes []string
+
+	for k, old := range a {
+		new, ok := b[k]
+		switch {
+		case !ok && old == nil:
+		case !ok:
+			changes = append(changes, fmt.Sprintf("- %v: %v", k, show(old)))
+		case !reflect.DeepEqual(old, new):
+			changes = append(changes, fmt.Sprintf("~ %v: %v -> %v", k, show(old), show(new)))
+		}
+	}
+
+	for k, new := range b {
+		if _, ok := a[k]; !ok && new != nil {
+			changes = append(changes, fmt.Sprintf("+ %v: %v", k, show(new)))
+		}
+	}
+
+	// sort by field name, not by the +/-/~ marker
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i][2:] < changes[j][2:]
+	})
+
+	return changes
+}
+
+// flatten walks v and stores every leaf value in out, keyed by its path (ports[0].source_device)
+func flatten(path string, v interface{}, out map[string]interface{}) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		// treat empty collections like null, since omitempty makes them interchangeable
+		if len(t) == 0 {
+			out[path] = nil
+		}
+		for k, child := range t {
+			flatten(path+"."+k, child, out)
+		}
+	case []interface{}:
+		if len(t) == 0 {
+			out[path] = nil
+		}
+		for i, child := range t {
+			flatten(fmt.Sprintf("%v[%v]", path, i), child, out)
+		}
+	default:
+		out[path] = v
+	}
+}
+
+func show(v interface{}) string {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprintf("%v", v)
+	}
+
+	return string(b)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// mapGetter is a target holding docs, keyed by db/id.
+type mapGetter map[string]map[string]interface{}
+
+func (m mapGetter) Get(db, id string) (map[string]interface{}, error) {
+	return m[db+"/"+id], nil
+}
+
+func TestFlatten(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want map[string]interface{}
+	}{
+		{"leaf", "a", map[string]interface{}{"x": "a"}},
+		{"null", nil, map[string]interface{}{"x": nil}},
+		{"empty map", map[string]interface{}{}, map[string]interface{}{"x": nil}},
+		{"empty list", []interface{}{}, map[string]interface{}{"x": nil}},
+		{
+			"nested",
+			map[string]interface{}{
+				"ports": []interface{}{
+					map[string]interface{}{"source_device": "ITB-1101-VIA1", "tags": []interface{}{"a"}},
+				},
+				"name": "D1",
+			},
+			map[string]interface{}{
+				"x.ports[0].source_device": "ITB-1101-VIA1",
+				"x.ports[0].tags[0]":       "a",
+				"x.name":                   "D1",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		out := make(map[string]interface{})
+		flatten("x", tt.v, out)
+
+		if !reflect.DeepEqual(out, tt.want) {
+			t.Errorf("%v: flatten = %v, want %v", tt.name, out, tt.want)
+		}
+	}
+}
+
+func TestDiffDocs(t *testing.T) {
+	tests := []struct {
+		name       string
+		have, want map[string]interface{}
+		changes    []string
+	}{
+		{
+			"same",
+			map[string]interface{}{"_id": "ITB", "_rev": "1-a", "name": "ITB"},
+			map[string]interface{}{"_id": "ITB", "name": "ITB"},
+			nil,
+		},
+		{
+			"changed, added and removed",
+			map[string]interface{}{"name": "ITB", "description": "old", "gone": "x"},
+			map[string]interface{}{"name": "ITB", "description": "new", "tags": []interface{}{"a"}},
+			[]string{`~ description: "old" -> "new"`, `- gone: "x"`, `+ tags[0]: "a"`},
+		},
+		{
+			"empty and missing are the same",
+			map[string]interface{}{"tags": []interface{}{}, "attributes": map[string]interface{}{}},
+			map[string]interface{}{},
+			nil,
+		},
+		{
+			"nested",
+			map[string]interface{}{"ports": []interface{}{map[string]interface{}{"_id": "hdmi!1"}}},
+			map[string]interface{}{"ports": []interface{}{map[string]interface{}{"_id": "hdmi!2"}}},
+			[]string{`~ ports[0]._id: "hdmi!1" -> "hdmi!2"`},
+		},
+	}
+
+	for _, tt := range tests {
+		changes := diffDocs(tt.have, tt.want)
+
+		if !reflect.DeepEqual(changes, tt.changes) {
+			t.Errorf("%v: diffDocs = %q, want %q", tt.name, changes, tt.changes)
+		}
+	}
+}
+
+func TestPlan(t *testing.T) {
+	target := mapGetter{
+		"buildings/ITB": {"_id": "ITB", "_rev": "1-a", "name": "ITB", "description": "old"},
+		"buildings/EB":  {"_id": "EB", "_rev": "1-b", "name": "EB"},
+	}
+
+	tests := []struct {
+		doc    Document
+		action string
+		out    string
+	}{
+		{Document{DB: "buildings", ID: "ITB", Body: map[string]interface{}{"name": "ITB", "description": "new"}}, actionUpdated, "update    buildings/ITB\n    ~ description: \"old\" -> \"new\"\n"},
+		{Document{DB: "buildings", ID: "EB", Body: map[string]interface{}{"name": "EB"}}, actionUnchanged, "unchanged buildings/EB\n"},
+		{Document{DB: "buildings", ID: "CTB", Body: map[string]interface{}{"name": "CTB"}}, actionCreated, "create    buildings/CTB\n"},
+	}
+
+	for _, tt := range tests {
+		var out bytes.Buffer
+		p := &planSink{target: target, out: &out}
+
+		results := p.Put(tt.doc)
+		if len(results) != 1 || results[0].Action != tt.action {
+			t.Errorf("%v: plan = %+v, want %v", tt.doc.ID, results, tt.action)
+		}
+
+		if out.String() != tt.out {
+			t.Errorf("%v: plan printed %q, want %q", tt.doc.ID, out.String(), tt.out)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/byuoitav/common/log"
+)
+
+// indexDesignDoc is the design document the migration's indexes are kept in
+const indexDesignDoc = "migration"
+
+// index is a Mango index the new system's queries need on a target database.
+type index struct {
+	db     string
+	name   string
+	fields []string
+}
+
+// requiredIndexes returns the indexes to install, on the databases as dbs names them.
+func requiredIndexes(dbs databases) []index {
+	return []index{
+		{db: dbs.rooms, name: "rooms-by-designation", fields: []string{"designation"}},
+		{db: dbs.rooms, name: "rooms-by-configuration", fields: []string{"configuration._id"}},
+		{db: dbs.devices, name: "devices-by-type", fields: []string{"type._id"}},
+		{db: dbs.devices, name: "devices-by-address", fields: []string{"address"}},
+	}
+}
+
+// preflight checks that the old config db can be read, and that couch is reachable and each of dbs
+// exists (creating it with --create-dbs), can be written to and has its indexes, before anything is migrated.
+// Every problem found is reported; it returns false if there were any.
+func (r *run) preflight(ctx context.Context, o *options, couch *couchSink, dbs []string) bool {
+	log.L.Info("Starting preflight...")
+
+	ok := r.checkSource(ctx, o)
+
+	if err := r.checkCouch(couch); err != nil {
+		r.report.Errorf("Failed to reach couch at %v : %v", o.address, err)
+		return false
+	}
+
+	for _, db := range dbs {
+		if ctx.Err() != nil {
+			return false
+		}
+
+		if err := checkDB(couch, db, o.createDBs); err != nil {
+			r.report.Errorf("Database %v isn't ready : %v", db, err)
+			ok = false
+			continue
+		}
+
+		if err := r.probe(couch, db); err != nil {
+			r.report.Errorf("Unable to write to %v : %v", db, err)
+			ok = false
+			continue
+		}
+
+		for _, i := range requiredIndexes(r.dbs) {
+			if i.db != db {
+				continue
+			}
+
+			if err := installIndex(couch, i); err != nil {
+				r.report.Errorf("Failed to install index %v on %v : %v", i.name, db, err)
+				ok = false
+			}
+		}
+	}
+
+	if ok {
+		log.L.Infof("Preflight passed for %v", strings.Join(dbs, ", "))
+	}
+
+	return ok
+}
+
+// checkSource makes sure the old config db (or the snapshot standing in for it) can be read.
+func (r *run) checkSource(ctx context.Context, o *options) bool {
+	if len(o.snapshot) > 0 {
+		f, err := os.Open(o.snapshot)
+		if err != nil {
+			r.report.Errorf("Unable to read source snapshot : %v", err)
+			return false
+		}
+
+		f.Close()
+		return true
+	}
+
+	buildings, err := dboSource{timeout: o.timeout}.GetBuildings(ctx)
+	if err != nil {
+		r.report.Errorf("Failed to reach the old config db : %v", err)
+		return false
+	}
+
+	log.L.Infof("Reached the old config db, it has %v buildings", len(buildings))
+	return true
+}
+
+// checkCouch makes sure couch answers, and logs who it sees the requests as coming from.
+func (r *run) checkCouch(couch *couchSink) error {
+	status, b, err := couch.do("GET", "", nil)
+	if err != nil {
+		return err
+	}
+
+	if status/100 != 2 {
+		ce := parseCouchError(b)
+		return fmt.Errorf("%v %v (%v)", status, ce.Error, ce.Reason)
+	}
+
+	var welcome struct {
+		Version string `json:"version"`
+	}
+	json.Unmarshal(b, &welcome)
+
+	status, b, err = couch.do("GET", "_session", nil)
+	if err != nil {
+		return err
+	}
+
+	var session struct {
+		UserCtx struct {
+			Name  string   `json:"name"`
+			Roles []string `json:"roles"`
+		} `json:"userCtx"`
+	}
+
+	if status/100 != 2 || json.Unmarshal(b, &session) != nil || len(session.UserCtx.Name) == 0 {
+		r.report.Warnf("Couch %v at %v isn't treating requests as coming from any user", welcome.Version, couch.address)
+		return nil
+	}
+
+	log.L.Infof("Reached couch %v at %v as %v (roles %v)", welcome.Version, couch.address, session.UserCtx.Name, strings.Join(session.UserCtx.Roles, ", "))
+	return nil
+}
+
+// checkDB makes sure db exists, creating it if create is set.
+func checkDB(couch *couchSink, db string, create bool) error {
+	status, b, err := couch.do("GET", db, nil)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case status/100 == 2:
+		return nil
+	case status != http.StatusNotFound:
+		ce := parseCouchError(b)
+		return fmt.Errorf("%v %v (%v)", status, ce.Error, ce.Reason)
+	case !create:
+		return fmt.Errorf("it doesn't exist (use --create-dbs to create it)")
+	}
+
+	status, b, err = couch.do("PUT", db, nil)
+	if err != nil {
+		return err
+	}
+
+	// precondition failed means something else created it first
+	if status/100 != 2 && status != http.StatusPreconditionFailed {
+		ce := parseCouchError(b)
+		return fmt.Errorf("unable to create it : %v %v (%v)", status, ce.Error, ce.Reason)
+	}
+
+	log.L.Infof("Created database %v", db)
+	return nil
+}
+
+// probe writes a document to db and deletes it again, to find out whether the credentials can write there.
+func (r *run) probe(couch *couchSink, db string) error {
+	id := fmt.Sprintf("migration-preflight-%v", newRunID())
+
+	body, err := json.Marshal(map[string]interface{}{"_id": id, "preflight": true})
+	if err != nil {
+		return fmt.Errorf("cannot marshal probe : %v", err)
+	}
+
+	status, b, err := couch.do("PUT", fmt.Sprintf("%v/%v", db, id), body)
+	if err != nil {
+		return err
+	}
+
+	if status/100 != 2 {
+		ce := parseCouchError(b)
+		return fmt.Errorf("%v %v (%v)", status, ce.Error, ce.Reason)
+	}
+
+	var ok couchOK
+	if err := json.Unmarshal(b, &ok); err != nil {
+		return fmt.Errorf("unable to parse response : %v", err)
+	}
+
+	if _, err := couch.Delete(db, id, ok.Rev); err != nil {
+		r.report.Warnf("Failed to clean up probe document : %v", err)
+	}
+
+	return nil
+}
+
+// installIndex creates i in the migration's design document, if it isn't there already.
+func installIndex(couch *couchSink, i index) error {
+	req := map[string]interface{}{
+		"index": map[string]interface{}{"fields": i.fields},
+		"ddoc":  indexDesignDoc,
+		"name":  i.name,
+		"type":  "json",
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return fmt.Errorf("cannot marshal index : %v", err)
+	}
+
+	status, b, err := couch.do("POST", fmt.Sprintf("%v/_index", i.db), body)
+	if err != nil {
+		return err
+	}
+
+	if status/100 != 2 {
+		ce := parseCouchError(b)
+		return fmt.Errorf("%v %v (%v)", status, ce.Error, ce.Reason)
+	}
+
+	var resp struct {
+		Result string `json:"result"`
+	}
+	json.Unmarshal(b, &resp)
+
+	log.L.Debugf("Index %v on %v : %v", i.name, i.db, resp.Result)
+	return nil
+}
+
+// targetDBs returns the databases a run of phases writes to, as selected with --only.
+func (r *run) targetDBs(o *options, phases []string) []string {
+	var dbs []string
+	seen := make(map[string]bool)
+
+	add := func(db string) {
+		if !seen[db] {
+			seen[db] = true
+			dbs = append(dbs, db)
+		}
+	}
+
+	for _, phase := range phases {
+		for _, db := range r.phaseWrites(phase) {
+			if r.selected.writes(db) {
+				add(db)
+			}
+		}
+	}
+
+	if len(o.crosswalkDoc) > 0 {
+		add(strings.SplitN(o.crosswalkDoc, "/", 2)[0])
+	}
+
+	return dbs
+}
+
+// runPreflight only runs the preflight checks for the databases a migrate with the same flags would write to.
+func runPreflight(o *options) {
+	r, phases := setup(o)
+
+	ctx, cancel := runContext(o.deadline)
+	defer cancel()
+
+	couch := newCouchSink(ctx, o, overwriteExisting)
+	r.preflight(ctx, o, couch, r.targetDBs(o, phases))
+	r.stopped(ctx)
+
+	r.finish(o.reportPath)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPreflight(t *testing.T) {
+	snapshot, err := ioutil.TempFile("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot.Close()
+	defer os.Remove(snapshot.Name())
+
+	f := newFakeCouch("buildings")
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	couch := testCouch(srv.URL, overwriteExisting)
+	o := &options{snapshot: snapshot.Name(), address: srv.URL}
+	dbs := []string{"buildings", "rooms"}
+
+	// a missing database fails without --create-dbs
+	r := testRun(&recordSink{}, divergentReport)
+	if r.preflight(context.Background(), o, couch, dbs) {
+		t.Fatalf("preflight passed with rooms missing")
+	}
+	if len(r.report.Errors) != 1 || !strings.Contains(r.report.Errors[0], "--create-dbs") {
+		t.Errorf("errors = %v, want rooms to be missing", r.report.Errors)
+	}
+
+	f.mu.Lock()
+	_, created := f.dbs["rooms"]
+	f.mu.Unlock()
+	if created {
+		t.Errorf("rooms was created without --create-dbs")
+	}
+
+	// and is created with it, twice over to check the indexes install again cleanly
+	o.createDBs = true
+	for i := 0; i < 2; i++ {
+		r = testRun(&recordSink{}, divergentReport)
+		if !r.preflight(context.Background(), o, couch, dbs) {
+			t.Fatalf("preflight %v failed : %v", i+1, r.report.Errors)
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	// the probe documents are cleaned up
+	for _, db := range dbs {
+		for id := range f.dbs[db] {
+			t.Errorf("%v/%v was left behind", db, id)
+		}
+	}
+
+	want := map[string][]string{
+		"rooms-by-designation":   {"designation"},
+		"rooms-by-configuration": {"configuration._id"},
+	}
+	if !reflect.DeepEqual(f.indexes["rooms"], want) {
+		t.Errorf("rooms indexes = %v, want %v", f.indexes["rooms"], want)
+	}
+	if len(f.indexes["buildings"]) > 0 {
+		t.Errorf("buildings indexes = %v, want none", f.indexes["buildings"])
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+
+	"github.com/byuoitav/common/log"
+	"github.com/byuoitav/device-monitoring-microservice/statusinfrastructure"
+)
+
+// provenanceField is the field of each document that provenance is stamped into
+const provenanceField = "migration"
+
+// Provenance says where a migrated document came from. Its fields are snake_case, like the rest of the document.
+type Provenance struct {
+	Source     string    `json:"source"`
+	OldType    string    `json:"old_type,omitempty"`
+	OldID      int       `json:"old_id,omitempty"`
+	RunID      string    `json:"run_id"`
+	Version    string    `json:"version"`
+	MigratedAt time.Time `json:"migrated_at"`
+}
+
+// provenanceSink stamps provenance on every document before handing it to the next sink.
+type provenanceSink struct {
+	next    Sink
+	source  string
+	runID   string
+	version string
+}
+
+func newProvenanceSink(next Sink, source, runID string) *provenanceSink {
+	return &provenanceSink{
+		next:    next,
+		source:  source,
+		runID:   runID,
+		version: toolVersion(),
+	}
+}
+
+// toolVersion is the version of the migration, from version.txt.
+func toolVersion() string {
+	version, err := statusinfrastructure.GetVersion("version.txt")
+	if err != nil {
+		log.L.Warnf("Unable to read version.txt, using version unknown : %v", err)
+		return "unknown"
+	}
+
+	return version
+}
+
+func (p *provenanceSink) Put(doc Document) []Result {
+	body, err := toMap(doc.Body)
+	if err != nil {
+		return []Result{doc.failed(err)}
+	}
+
+	body[provenanceField] = Provenance{
+		Source:     p.source,
+		OldType:    doc.OldType,
+		OldID:      doc.OldID,
+		RunID:      p.runID,
+		Version:    p.version,
+		MigratedAt: time.Now(),
+	}
+
+	doc.Body = body
+	return p.next.Put(doc)
+}
+
+func (p *provenanceSink) Flush() []Result {
+	return p.next.Flush()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestProvenanceSink(t *testing.T) {
+	sink := &recordSink{}
+	p := newProvenanceSink(sink, "configuration-database-microservice", "20180612-142233-3f9a1c")
+	p.Put(Document{DB: "devices", ID: "ITB-1101-D1", Body: map[string]interface{}{"name": "D1"}, OldType: "device", OldID: 1234})
+
+	body, err := toMap(sink.docs[0].Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stamp, ok := body[provenanceField].(map[string]interface{})
+	if !ok {
+		t.Fatalf("%v = %v, want a provenance stamp", provenanceField, body[provenanceField])
+	}
+
+	var keys []string
+	for _, k := range []string{"source", "old_type", "old_id", "run_id", "version", "migrated_at"} {
+		if _, ok := stamp[k]; ok {
+			keys = append(keys, k)
+		}
+	}
+
+	if len(keys) != len(stamp) || len(keys) != 6 {
+		t.Errorf("stamp = %v, want source, old_type, old_id, run_id, version and migrated_at", stamp)
+	}
+}
+
+func TestDiffDocsProvenance(t *testing.T) {
+	stamp := map[string]interface{}{"run_id": "20180612-142233-3f9a1c"}
+	restamp := map[string]interface{}{"run_id": "20180613-090000-aaaaaa"}
+
+	tests := []struct {
+		name       string
+		have, want map[string]interface{}
+		changes    []string
+	}{
+		{
+			"provenance from another run",
+			map[string]interface{}{"name": "ITB", provenanceField: stamp},
+			map[string]interface{}{"name": "ITB", provenanceField: restamp},
+			nil,
+		},
+		{
+			"provenance missing",
+			map[string]interface{}{"name": "ITB"},
+			map[string]interface{}{"name": "ITB", provenanceField: restamp},
+			[]string{`+ migration.run_id: "20180613-090000-aaaaaa"`},
+		},
+		{
+			"provenance dropped",
+			map[string]interface{}{"name": "ITB", provenanceField: stamp},
+			map[string]interface{}{"name": "ITB"},
+			nil,
+		},
+	}
+
+	for _, tt := range tests {
+		changes := diffDocs(tt.have, tt.want)
+
+		if !reflect.DeepEqual(changes, tt.changes) {
+			t.Errorf("%v: diffDocs = %q, want %q", tt.name, changes, tt.changes)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/log"
+)
+
+// Report is the outcome of a whole migration run.
+type Report struct {
+	RunID    string    `json:"run-id,omitempty"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+	DryRun   bool      `json:"dry-run,omitempty"`
+
+	// Counts is the number of documents per database, per action
+	Counts map[string]map[string]int `json:"counts"`
+
+	// Failures are the documents that could not be written
+	Failures []Result `json:"failures,omitempty"`
+
+	// Errors are problems that weren't tied to a single document, like failing to read from the source
+	Errors []string `json:"errors,omitempty"`
+
+	// Warnings are problems that don't fail the run
+	Warnings []string `json:"warnings,omitempty"`
+
+	mu sync.Mutex
+}
+
+func newReport() *Report {
+	return &Report{
+		Started: time.Now(),
+		Counts:  make(map[string]map[string]int),
+	}
+}
+
+// Add records the outcome of writing documents.
+func (r *Report) Add(results ...Result) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, res := range results {
+		r.add(res)
+	}
+}
+
+func (r *Report) add(res Result) {
+	if _, ok := r.Counts[res.DB]; !ok {
+		r.Counts[res.DB] = make(map[string]int)
+	}
+	r.Counts[res.DB][res.Action]++
+
+	switch res.Action {
+	case actionFailed:
+		log.L.Errorf("Failed to write %v/%v (%v) : %v %v %v", res.DB, res.ID, res.Origin, res.Status, res.Error, res.Reason)
+		r.Failures = append(r.Failures, res)
+	case actionMissing, actionMismatched, actionExtra:
+		log.L.Warnf("%v/%v is %v %v", res.DB, res.ID, res.Action, res.Reason)
+		r.Failures = append(r.Failures, res)
+	}
+}
+
+// Errorf records a failure that isn't tied to a single document.
+func (r *Report) Errorf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	log.L.Error(msg)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Errors = append(r.Errors, msg)
+}
+
+// Warnf records a problem that doesn't fail the run.
+func (r *Report) Warnf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	log.L.Warn(msg)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Warnings = append(r.Warnings, msg)
+}
+
+// Failed is true if anything went wrong during the run.
+func (r *Report) Failed() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return len(r.Failures) > 0 || len(r.Errors) > 0
+}
+
+// Print writes a human readable summary of the report to w.
+func (r *Report) Print(w io.Writer) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// only show the columns for actions that happened
+	var actions []string
+	for _, a := range []string{actionCreated, actionUpdated, actionUnchanged, actionSkipped, actionDeleted, actionRestored, actionMatched, actionMissing, actionMismatched, actionExtra, actionFailed} {
+		for db := range r.Counts {
+			if r.Counts[db][a] > 0 {
+				actions = append(actions, a)
+				break
+			}
+		}
+	}
+
+	var dbs []string
+	for db := range r.Counts {
+		dbs = append(dbs, db)
+	}
+	sort.Strings(dbs)
+
+	fmt.Fprintf(w, "\n%-22s", "")
+	for _, a := range actions {
+		fmt.Fprintf(w, "%10s", a)
+	}
+	fmt.Fprintln(w)
+
+	for _, db := range dbs {
+		fmt.Fprintf(w, "%-22s", db)
+		for _, a := range actions {
+			fmt.Fprintf(w, "%10d", r.Counts[db][a])
+		}
+		fmt.Fprintln(w)
+	}
+
+	if len(r.Failures) > 0 {
+		fmt.Fprintf(w, "\n%v failed documents:\n", len(r.Failures))
+		for _, f := range r.Failures {
+			fmt.Fprintf(w, "    %v %v/%v (%v): %v %v %v\n", f.Action, f.DB, f.ID, f.Origin, f.Status, f.Error, f.Reason)
+		}
+	}
+
+	if len(r.Warnings) > 0 {
+		fmt.Fprintf(w, "\n%v warnings:\n", len(r.Warnings))
+		for _, e := range r.Warnings {
+			fmt.Fprintf(w, "    %v\n", e)
+		}
+	}
+
+	if len(r.Errors) > 0 {
+		fmt.Fprintf(w, "\n%v errors:\n", len(r.Errors))
+		for _, e := range r.Errors {
+			fmt.Fprintf(w, "    %v\n", e)
+		}
+	}
+}
+
+// Save writes the report as JSON to path.
+func (r *Report) Save(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, err := json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot marshal report : %v", err)
+	}
+
+	if err := ioutil.WriteFile(path, b, 0644); err != nil {
+		return fmt.Errorf("unable to write report to %v : %v", path, err)
+	}
+
+	return nil
+}
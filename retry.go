@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/log"
+)
+
+// retryPolicy is how requests to couch are retried.
+type retryPolicy struct {
+	attempts int           // most times a request is tried, including the first
+	delay    time.Duration // wait before the first retry, doubled (with jitter) for each one after
+	maxDelay time.Duration
+
+	// after this many failures in a row (across every request) the run pauses for breakerPause
+	breakerThreshold int
+	breakerPause     time.Duration
+}
+
+// defaultRetry is the policy used unless it is changed with flags
+var defaultRetry = retryPolicy{
+	attempts:         5,
+	delay:            500 * time.Millisecond,
+	maxDelay:         30 * time.Second,
+	breakerThreshold: 10,
+	breakerPause:     time.Minute,
+}
+
+// retryable is true for the responses that mean couch may accept the same request later.
+func retryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff is how long to wait before retry number n (starting at 1): the delay doubled n-1 times,
+// capped at maxDelay, with up to half of it randomized so parallel workers don't retry in lockstep.
+// A Retry-After header from couch is honored if it asks for longer.
+func (p retryPolicy) backoff(n int, header http.Header) time.Duration {
+	d := p.delay
+	for i := 1; i < n && d < p.maxDelay; i++ {
+		d *= 2
+	}
+	if d > p.maxDelay {
+		d = p.maxDelay
+	}
+
+	if half := int64(d / 2); half > 0 {
+		d = time.Duration(half + rand.Int63n(half+1))
+	}
+
+	if header != nil {
+		if secs, err := strconv.Atoi(header.Get("Retry-After")); err == nil && time.Duration(secs)*time.Second > d {
+			d = time.Duration(secs) * time.Second
+		}
+	}
+
+	return d
+}
+
+// sleep waits for d, returning false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// breaker stops every request to the target for a while once it has failed too many times in a row,
+// so a struggling couch gets a chance to recover instead of being hammered, and nothing is given up on while it does.
+type breaker struct {
+	threshold int
+	pause     time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(threshold int, pause time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		pause:     pause,
+	}
+}
+
+// wait blocks until the breaker is closed, or ctx is done.
+func (b *breaker) wait(ctx context.Context) error {
+	for {
+		b.mu.Lock()
+		d := time.Until(b.openUntil)
+		b.mu.Unlock()
+
+		if d <= 0 {
+			return nil
+		}
+
+		if !sleep(ctx, d) {
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *breaker) success() {
+	b.mu.Lock()
+	b.failures = 0
+	b.mu.Unlock()
+}
+
+func (b *breaker) failure() {
+	if b.threshold <= 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.failures++
+	if b.failures < b.threshold || time.Now().Before(b.openUntil) {
+		return
+	}
+
+	log.L.Warnf("The target has failed %v times in a row, pausing for %v", b.failures, b.pause)
+	b.openUntil = time.Now().Add(b.pause)
+
+	// one more failure once the pause is over opens it again
+	b.failures = b.threshold - 1
+}
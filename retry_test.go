@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	p := retryPolicy{delay: time.Second, maxDelay: 10 * time.Second}
+
+	tests := []struct {
+		n          int
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{1, "", 500 * time.Millisecond, time.Second},
+		{2, "", time.Second, 2 * time.Second},
+		{3, "", 2 * time.Second, 4 * time.Second},
+		{4, "", 4 * time.Second, 8 * time.Second},
+		{5, "", 5 * time.Second, 10 * time.Second},
+		{50, "", 5 * time.Second, 10 * time.Second},
+		{1, "30", 30 * time.Second, 30 * time.Second},
+		{4, "1", 4 * time.Second, 8 * time.Second},
+		{1, "soon", 500 * time.Millisecond, time.Second},
+	}
+
+	for _, tt := range tests {
+		header := make(http.Header)
+		if len(tt.retryAfter) > 0 {
+			header.Set("Retry-After", tt.retryAfter)
+		}
+
+		// the jitter is random, so try each enough times to see it
+		for i := 0; i < 100; i++ {
+			if d := p.backoff(tt.n, header); d < tt.min || d > tt.max {
+				t.Errorf("backoff(%v) with Retry-After %q = %v, want between %v and %v", tt.n, tt.retryAfter, d, tt.min, tt.max)
+				break
+			}
+		}
+	}
+
+	if d := (retryPolicy{}).backoff(3, nil); d != 0 {
+		t.Errorf("backoff without a delay = %v, want 0", d)
+	}
+}
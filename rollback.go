@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/log"
+)
+
+// Manifest is every document a run created or changed, with enough detail to undo it.
+type Manifest struct {
+	RunID   string    `json:"run-id"`
+	Started time.Time `json:"started"`
+	Target  string    `json:"target"`
+	Changes []Change  `json:"changes"`
+
+	// index is the position of each document (db/id) in Changes
+	index map[string]int
+
+	path string
+	mu   sync.Mutex
+}
+
+// Change is a single document created or updated by a run.
+type Change struct {
+	DB     string `json:"db"`
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	Rev    string `json:"rev"`
+
+	// Previous is the document as it was before an update
+	Previous map[string]interface{} `json:"previous,omitempty"`
+}
+
+// newRunID identifies a run by when it started, with a random suffix so runs started in the same second don't collide.
+func newRunID() string {
+	suffix := make([]byte, 3)
+	if _, err := rand.Read(suffix); err != nil {
+		return time.Now().Format("20060102-150405.000000000")
+	}
+
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// newManifest creates an empty manifest for runID that will be saved in dir.
+// Nothing is saved if dir is empty.
+func newManifest(dir, runID, target string) *Manifest {
+	m := &Manifest{
+		RunID:   runID,
+		Started: time.Now(),
+		Target:  target,
+	}
+
+	if len(dir) > 0 {
+		m.path = filepath.Join(dir, runID+".json")
+	}
+
+	return m
+}
+
+func loadManifest(dir, runID string) (*Manifest, error) {
+	path := filepath.Join(dir, runID+".json")
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read manifest %v : %v", path, err)
+	}
+
+	m := &Manifest{path: path}
+	if err := json.Unmarshal(b, m); err != nil {
+		return nil, fmt.Errorf("unable to parse manifest %v : %v", path, err)
+	}
+
+	return m, nil
+}
+
+// Add records every document in results that was created or updated.
+// A document written more than once keeps its first action and previous content, and its latest revision.
+func (m *Manifest) Add(results ...Result) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.index == nil {
+		m.index = make(map[string]int)
+	}
+
+	for _, res := range results {
+		if res.Action != actionCreated && res.Action != actionUpdated {
+			continue
+		}
+
+		if i, ok := m.index[res.DB+"/"+res.ID]; ok {
+			m.Changes[i].Rev = res.Rev
+			continue
+		}
+
+		m.index[res.DB+"/"+res.ID] = len(m.Changes)
+		m.Changes = append(m.Changes, Change{
+			DB:       res.DB,
+			ID:       res.ID,
+			Action:   res.Action,
+			Rev:      res.Rev,
+			Previous: res.Previous,
+		})
+	}
+}
+
+// Save writes the manifest to disk.
+func (m *Manifest) Save() error {
+	if len(m.path) == 0 {
+		return nil
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(m.path), 0755); err != nil {
+		return fmt.Errorf("unable to create %v : %v", filepath.Dir(m.path), err)
+	}
+
+	b, err := json.MarshalIndent(m, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot marshal manifest : %v", err)
+	}
+
+	// write to a temp file first so a crash mid-write doesn't lose the manifest
+	tmp := m.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("unable to write manifest to %v : %v", m.path, err)
+	}
+
+	if err := os.Rename(tmp, m.path); err != nil {
+		return fmt.Errorf("unable to write manifest to %v : %v", m.path, err)
+	}
+
+	return nil
+}
+
+// rollback undoes every change in m, newest first. Documents that were created are deleted,
+// and documents that were updated are put back the way they were. A document that has been
+// changed again since the run is left alone and reported as a failure.
+func rollback(ctx context.Context, m *Manifest, couch *couchSink, report *Report) {
+	log.L.Infof("Rolling back run %v (%v changes)", m.RunID, len(m.Changes))
+
+	for i := len(m.Changes) - 1; i >= 0 && ctx.Err() == nil; i-- {
+		report.Add(undo(m.Changes[i], couch))
+	}
+}
+
+func undo(c Change, couch *couchSink) Result {
+	doc := Document{DB: c.DB, ID: c.ID, Origin: fmt.Sprintf("%v by the run", c.Action)}
+
+	current, err := couch.Get(c.DB, c.ID)
+	if err != nil {
+		return doc.failed(err)
+	}
+
+	if current == nil {
+		if c.Action == actionCreated {
+			// already gone
+			return doc.result(actionUnchanged)
+		}
+
+		return doc.failed(fmt.Errorf("%v/%v has been deleted since the run", c.DB, c.ID))
+	}
+
+	if rev, _ := current["_rev"].(string); rev != c.Rev {
+		return doc.failed(fmt.Errorf("%v/%v has changed since the run (now at %v, run wrote %v)", c.DB, c.ID, rev, c.Rev))
+	}
+
+	switch c.Action {
+	case actionCreated:
+		status, err := couch.Delete(c.DB, c.ID, c.Rev)
+		if err != nil {
+			res := doc.failed(err)
+			res.Status = status
+			return res
+		}
+
+		res := doc.result(actionDeleted)
+		res.Status = status
+		return res
+	default:
+		prev := make(map[string]interface{})
+		for k, v := range c.Previous {
+			prev[k] = v
+		}
+		prev["_rev"] = c.Rev
+
+		body, err := json.Marshal(prev)
+		if err != nil {
+			return doc.failed(fmt.Errorf("cannot marshal %v/%v : %v", c.DB, c.ID, err))
+		}
+
+		status, b, attempts, err := couch.send("PUT", fmt.Sprintf("%v/%v", c.DB, c.ID), body)
+		if err != nil {
+			return doc.failed(err)
+		}
+
+		res := doc.result(actionRestored)
+		res.Status = status
+
+		if status == http.StatusConflict && attempts > 1 {
+			restored := doc
+			restored.Body = c.Previous
+
+			current, err := couch.Get(c.DB, c.ID)
+			if err == nil && landed(restored, current) {
+				return res
+			}
+		}
+
+		if status/100 != 2 {
+			ce := parseCouchError(b)
+
+			res.Action = actionFailed
+			res.Error = ce.Error
+			res.Reason = ce.Reason
+		}
+
+		return res
+	}
+}
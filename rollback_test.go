@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	f := newFakeCouch("rooms")
+	f.dbs["rooms"]["ITB-1102"] = map[string]interface{}{"_id": "ITB-1102", "_rev": "1-old", "name": "old"}
+	f.dbs["rooms"]["ITB-1103"] = map[string]interface{}{"_id": "ITB-1103", "_rev": "1-old", "name": "old"}
+	srv := httptest.NewServer(f)
+	defer srv.Close()
+
+	couch := testCouch(srv.URL, overwriteExisting)
+
+	m := newManifest("", "test", srv.URL)
+	for _, id := range []string{"ITB-1101", "ITB-1102", "ITB-1103"} {
+		m.Add(couch.Put(Document{DB: "rooms", ID: id, Body: map[string]interface{}{"name": "new"}})...)
+	}
+
+	// changed by someone else after the run
+	f.mu.Lock()
+	f.write("rooms", "ITB-1103", map[string]interface{}{"_rev": f.dbs["rooms"]["ITB-1103"]["_rev"], "name": "newer"})
+	f.mu.Unlock()
+
+	report := newReport()
+	rollback(context.Background(), m, couch, report)
+
+	if doc := f.doc("rooms", "ITB-1101"); doc != nil {
+		t.Errorf("rooms/ITB-1101 = %v, want it deleted", doc)
+	}
+	if doc := f.doc("rooms", "ITB-1102"); doc == nil || doc["name"] != "old" {
+		t.Errorf("rooms/ITB-1102 = %v, want it restored", doc)
+	}
+	if doc := f.doc("rooms", "ITB-1103"); doc == nil || doc["name"] != "newer" {
+		t.Errorf("rooms/ITB-1103 = %v, want it left alone", doc)
+	}
+
+	want := map[string]int{actionDeleted: 1, actionRestored: 1, actionFailed: 1}
+	for action, n := range want {
+		if report.Counts["rooms"][action] != n {
+			t.Errorf("rooms %v = %v, want %v", action, report.Counts["rooms"][action], n)
+		}
+	}
+}
+
+func TestNewRunID(t *testing.T) {
+	seen := make(map[string]bool)
+
+	for i := 0; i < 1000; i++ {
+		id := newRunID()
+		if seen[id] {
+			t.Fatalf("run id %v was made twice", id)
+		}
+
+		seen[id] = true
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/byuoitav/configuration-database-microservice/structs"
+)
+
+// scope limits a migration to part of the old configuration database.
+// An empty set means everything is included. Values match exactly, so itb is not the building ITB.
+type scope struct {
+	buildings    map[string]bool // building shortnames (ITB)
+	rooms        map[string]bool // room ids (ITB-1101)
+	designations map[string]bool // room designations (production)
+	only         map[string]bool // target databases to write
+}
+
+// the names --only accepts, and the database each one means
+func onlyNames(dbs databases) map[string]string {
+	return map[string]string{
+		"buildings":           dbs.buildings,
+		"rooms":               dbs.rooms,
+		"room_configurations": dbs.roomConfigurations,
+		"devices":             dbs.devices,
+		"device_types":        dbs.deviceTypes,
+	}
+}
+
+func newScope(buildings, rooms, designations, only string, dbs databases) (*scope, error) {
+	s := &scope{
+		buildings:    splitSet(buildings),
+		rooms:        splitSet(rooms),
+		designations: splitSet(designations),
+		only:         make(map[string]bool),
+	}
+
+	names := onlyNames(dbs)
+	for name := range splitSet(only) {
+		db, ok := names[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown database %q in --only (must be buildings, rooms, room_configurations, devices or device_types)", name)
+		}
+
+		s.only[db] = true
+	}
+
+	return s, nil
+}
+
+func splitSet(list string) map[string]bool {
+	set := make(map[string]bool)
+	for _, v := range strings.Split(list, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			set[v] = true
+		}
+	}
+
+	return set
+}
+
+// filtered is true if the scope narrows down which rooms are migrated.
+func (s *scope) filtered() bool {
+	return len(s.buildings) > 0 || len(s.rooms) > 0 || len(s.designations) > 0
+}
+
+// writes is true if documents in db should be written.
+func (s *scope) writes(db string) bool {
+	return len(s.only) == 0 || s.only[db]
+}
+
+func (s *scope) includesRoom(building string, r structs.Room) bool {
+	if len(s.buildings) > 0 && !s.buildings[building] {
+		return false
+	}
+	if len(s.rooms) > 0 && !s.rooms[fmt.Sprintf("%s-%s", building, r.Name)] {
+		return false
+	}
+	if len(s.designations) > 0 && !s.designations[r.RoomDesignation] {
+		return false
+	}
+
+	return true
+}
+
+// apply narrows the building, room and configuration lists down to the selected rooms,
+// the buildings they are in and the configurations they use. It returns a problem for
+// every --building, --room and --designation value that didn't select anything.
+func (s *scope) apply() []string {
+	if !s.filtered() {
+		return nil
+	}
+
+	shortnames := make(map[int]string)
+	for _, b := range buildingList {
+		shortnames[b.ID] = b.Shortname
+	}
+
+	var rooms []structs.Room
+	usedBuildings := make(map[int]bool)
+	usedConfigs := make(map[int]bool)
+
+	// every value there is, and the ones the selected rooms have
+	known := map[string]map[string]bool{"building": {}, "room": {}, "designation": {}}
+	matched := map[string]map[string]bool{"building": {}, "room": {}, "designation": {}}
+
+	for _, r := range roomList {
+		key := fmt.Sprintf("%s-%s", shortnames[r.Building.ID], r.Name)
+		known["room"][key] = true
+		known["designation"][r.RoomDesignation] = true
+
+		if !s.includesRoom(shortnames[r.Building.ID], r) {
+			continue
+		}
+
+		rooms = append(rooms, r)
+		usedBuildings[r.Building.ID] = true
+		usedConfigs[r.ConfigurationID] = true
+
+		matched["room"][key] = true
+		matched["designation"][r.RoomDesignation] = true
+	}
+
+	var buildings []structs.Building
+	for _, b := range buildingList {
+		known["building"][b.Shortname] = true
+
+		// a building asked for by name is migrated even if it has no matching rooms
+		if usedBuildings[b.ID] || s.buildings[b.Shortname] {
+			buildings = append(buildings, b)
+			matched["building"][b.Shortname] = true
+		}
+	}
+
+	var configs []structs.RoomConfiguration
+	for _, c := range configList {
+		if usedConfigs[c.ID] {
+			configs = append(configs, c)
+		}
+	}
+
+	roomList, buildingList, configList = rooms, buildings, configs
+
+	var problems []string
+	problems = append(problems, unmatched("building", s.buildings, matched["building"], known["building"])...)
+	problems = append(problems, unmatched("room", s.rooms, matched["room"], known["room"])...)
+	problems = append(problems, unmatched("designation", s.designations, matched["designation"], known["designation"])...)
+
+	return problems
+}
+
+// unmatched describes each of values (given with --flag) that isn't in matched, pointing out
+// when it only differs in case from one that is known.
+func unmatched(flag string, values, matched, known map[string]bool) []string {
+	var sorted []string
+	for v := range values {
+		if !matched[v] {
+			sorted = append(sorted, v)
+		}
+	}
+	sort.Strings(sorted)
+
+	var problems []string
+	for _, v := range sorted {
+		problem := fmt.Sprintf("--%v %v matches nothing", flag, v)
+		for k := range known {
+			if k != v && strings.EqualFold(k, v) {
+				problem += fmt.Sprintf(" (values are case sensitive, did you mean %v?)", k)
+				break
+			}
+		}
+
+		problems = append(problems, problem)
+	}
+
+	return problems
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/byuoitav/configuration-database-microservice/structs"
+)
+
+func TestScopeApply(t *testing.T) {
+	itb := structs.Building{ID: 1, Shortname: "ITB"}
+	eb := structs.Building{ID: 2, Shortname: "EB"}
+	ctb := structs.Building{ID: 3, Shortname: "CTB"}
+
+	room := func(building structs.Building, name string, config int, designation string) structs.Room {
+		return structs.Room{Name: name, Building: building, ConfigurationID: config, RoomDesignation: designation}
+	}
+
+	rooms := []structs.Room{
+		room(itb, "1101", 1, "production"),
+		room(itb, "1102", 2, "stage"),
+		room(eb, "101", 1, "production"),
+	}
+	buildings := []structs.Building{itb, eb, ctb}
+	configs := []structs.RoomConfiguration{{ID: 1, Name: "Default"}, {ID: 2, Name: "Tiered"}, {ID: 3, Name: "Unused"}}
+
+	tests := []struct {
+		name                           string
+		buildings, rooms, designations string
+		wantRooms                      []string
+		wantBuildings                  []string
+		wantConfigs                    []string
+		wantProblems                   []string
+	}{
+		{"everything", "", "", "", []string{"1101", "1102", "101"}, []string{"ITB", "EB", "CTB"}, []string{"Default", "Tiered", "Unused"}, nil},
+		{"building", "ITB", "", "", []string{"1101", "1102"}, []string{"ITB"}, []string{"Default", "Tiered"}, nil},
+		{"room", "", "ITB-1102", "", []string{"1102"}, []string{"ITB"}, []string{"Tiered"}, nil},
+		{"designation", "", "", "production", []string{"1101", "101"}, []string{"ITB", "EB"}, []string{"Default"}, nil},
+		{"building and designation", "ITB", "", "production", []string{"1101"}, []string{"ITB"}, []string{"Default"}, nil},
+		{"building without rooms", "CTB", "", "", nil, []string{"CTB"}, nil, nil},
+		{"no match", "", "EB-999", "", nil, nil, nil, []string{"--room EB-999 matches nothing"}},
+		{"some match", "", "ITB-1101,ITB-9999", "", []string{"1101"}, []string{"ITB"}, []string{"Default"}, []string{"--room ITB-9999 matches nothing"}},
+		{"wrong case", "itb", "", "", nil, nil, nil, []string{"--building itb matches nothing (values are case sensitive, did you mean ITB?)"}},
+		{"nothing left", "EB", "", "stage", nil, []string{"EB"}, nil, []string{"--designation stage matches nothing"}},
+	}
+
+	for _, tt := range tests {
+		roomList, buildingList, configList = rooms, buildings, configs
+
+		s, err := newScope(tt.buildings, tt.rooms, tt.designations, "", defaultDatabases)
+		if err != nil {
+			t.Fatalf("%v: newScope = %v", tt.name, err)
+		}
+		problems := s.apply()
+
+		var gotRooms, gotBuildings, gotConfigs []string
+		for _, r := range roomList {
+			gotRooms = append(gotRooms, r.Name)
+		}
+		for _, b := range buildingList {
+			gotBuildings = append(gotBuildings, b.Shortname)
+		}
+		for _, c := range configList {
+			gotConfigs = append(gotConfigs, c.Name)
+		}
+
+		if !reflect.DeepEqual(gotRooms, tt.wantRooms) {
+			t.Errorf("%v: rooms = %v, want %v", tt.name, gotRooms, tt.wantRooms)
+		}
+		if !reflect.DeepEqual(gotBuildings, tt.wantBuildings) {
+			t.Errorf("%v: buildings = %v, want %v", tt.name, gotBuildings, tt.wantBuildings)
+		}
+		if !reflect.DeepEqual(gotConfigs, tt.wantConfigs) {
+			t.Errorf("%v: configs = %v, want %v", tt.name, gotConfigs, tt.wantConfigs)
+		}
+		if !reflect.DeepEqual(problems, tt.wantProblems) {
+			t.Errorf("%v: problems = %q, want %q", tt.name, problems, tt.wantProblems)
+		}
+	}
+}
+
+func TestScopeOnly(t *testing.T) {
+	s, err := newScope("", "", "", "rooms, devices", defaultDatabases)
+	if err != nil {
+		t.Fatalf("newScope = %v", err)
+	}
+
+	if s.filtered() {
+		t.Errorf("--only alone shouldn't filter the rooms")
+	}
+	if !s.writes(defaultDatabases.rooms) || !s.writes(defaultDatabases.devices) || s.writes(defaultDatabases.buildings) {
+		t.Errorf("--only rooms,devices should write only rooms and devices")
+	}
+
+	if _, err := newScope("", "", "", "floors", defaultDatabases); err == nil {
+		t.Errorf("newScope accepted --only floors")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/byuoitav/common/log"
+)
+
+// runContext returns the context a run works under. It is cancelled when SIGINT or SIGTERM is received,
+// or once deadline (if non-zero) has passed. Cancelling it only stops new work from starting: documents
+// already being written are finished, so the checkpoint and report stay accurate. A second signal exits immediately.
+func runContext(deadline time.Duration) (context.Context, context.CancelFunc) {
+	var ctx context.Context
+	var cancel context.CancelFunc
+
+	if deadline > 0 {
+		ctx, cancel = context.WithTimeout(context.Background(), deadline)
+	} else {
+		ctx, cancel = context.WithCancel(context.Background())
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		if ctx.Err() == nil {
+			log.L.Warnf("Received %v, finishing the documents in progress before stopping (send it again to stop now)", sig)
+			cancel()
+
+			sig = <-signals
+		}
+
+		log.L.Errorf("Received %v, stopping without saving progress", sig)
+		os.Exit(130)
+	}()
+
+	return ctx, cancel
+}
+
+// stopped reports why ctx was cancelled, if it was, and returns true.
+func (r *run) stopped(ctx context.Context) bool {
+	switch ctx.Err() {
+	case nil:
+		return false
+	case context.DeadlineExceeded:
+		r.report.Errorf("Stopped early, the run went past its deadline")
+	default:
+		r.report.Errorf("Stopped early, the run was interrupted")
+	}
+
+	return true
+}
+
+// maxAbandoned is how many calls that were given up on can still be running before call refuses to start
+// any more, so a source that has stopped answering can't pile up goroutines and connections without end.
+const maxAbandoned = 64
+
+// abandoned is how many calls that were given up on are still running
+var abandoned int32
+
+// call runs fn, giving up on it if ctx is done or it takes longer than timeout.
+// fn is left running if it is given up on, so whatever it sets must only be read when call returns nil.
+// Once maxAbandoned of those are still running, call fails straight away until some of them finish.
+func call(ctx context.Context, timeout time.Duration, fn func() error) error {
+	if n := atomic.LoadInt32(&abandoned); n >= maxAbandoned {
+		return fmt.Errorf("not trying, %v earlier requests that timed out haven't finished", n)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		atomic.AddInt32(&abandoned, 1)
+		go func() {
+			<-done
+			atomic.AddInt32(&abandoned, -1)
+		}()
+
+		return ctx.Err()
+	}
+}
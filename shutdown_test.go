@@ -0,0 +1,41 @@
+package main
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCallAbandoned(t *testing.T) {
+	hung := make(chan struct{})
+	for i := 0; i < maxAbandoned; i++ {
+		if err := call(context.Background(), time.Millisecond, func() error {
+			<-hung
+			return nil
+		}); err != context.DeadlineExceeded {
+			t.Fatalf("call %v = %v, want it given up on", i, err)
+		}
+	}
+
+	ran := false
+	if err := call(context.Background(), time.Second, func() error {
+		ran = true
+		return nil
+	}); err == nil || ran {
+		t.Errorf("call with %v abandoned calls = %v (ran %v), want it refused", maxAbandoned, err, ran)
+	}
+
+	close(hung)
+	for i := 0; atomic.LoadInt32(&abandoned) > 0; i++ {
+		if i > 100 {
+			t.Fatalf("%v abandoned calls never finished", atomic.LoadInt32(&abandoned))
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if err := call(context.Background(), time.Second, func() error { return nil }); err != nil {
+		t.Errorf("call after the abandoned calls finished = %v", err)
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/byuoitav/common/log"
+)
+
+// databases are the names of the databases the migrated documents are written to.
+type databases struct {
+	buildings          string
+	rooms              string
+	roomConfigurations string
+	devices            string
+	deviceTypes        string
+}
+
+// the names used unless they are changed with flags
+var defaultDatabases = databases{
+	buildings:          "buildings",
+	rooms:              "rooms",
+	roomConfigurations: "room_configurations",
+	devices:            "devices",
+	deviceTypes:        "device_types",
+}
+
+// existingPolicy is what a sink does when a document it is asked to write already exists with different content.
+// Documents whose content is identical are always left alone.
+type existingPolicy string
+
+const (
+	overwriteExisting existingPolicy = "overwrite"
+	skipExisting      existingPolicy = "skip"
+	failExisting      existingPolicy = "fail"
+)
+
+func parseExistingPolicy(s string) (existingPolicy, error) {
+	switch p := existingPolicy(s); p {
+	case overwriteExisting, skipExisting, failExisting:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown policy %q (must be overwrite, skip or fail)", s)
+	}
+}
+
+// Document is a single migrated document, along with the old config db entity it was built from.
+type Document struct {
+	DB     string
+	ID     string
+	Origin string
+	Body   interface{}
+
+	// the type (building, room...) and numeric id of the old record, for the crosswalk
+	OldType string
+	OldID   int
+}
+
+// the outcomes of writing a document
+const (
+	actionCreated   = "created"
+	actionUpdated   = "updated"
+	actionUnchanged = "unchanged"
+	actionSkipped   = "skipped"
+	actionFailed    = "failed"
+
+	// used when rolling back a run
+	actionDeleted  = "deleted"
+	actionRestored = "restored"
+)
+
+// Result is the outcome of writing a single document.
+type Result struct {
+	DB     string `json:"db"`
+	ID     string `json:"id"`
+	Origin string `json:"origin,omitempty"`
+	Action string `json:"action"`
+	Status int    `json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// Rev is the revision that was written, if the sink has revisions
+	Rev string `json:"rev,omitempty"`
+
+	// Previous is what the document was before it was updated
+	Previous map[string]interface{} `json:"-"`
+}
+
+func (d Document) result(action string) Result {
+	return Result{
+		DB:     d.DB,
+		ID:     d.ID,
+		Origin: d.Origin,
+		Action: action,
+	}
+}
+
+func (d Document) failed(err error) Result {
+	r := d.result(actionFailed)
+	r.Error = err.Error()
+	return r
+}
+
+// decide applies policy to a document that is about to replace have (nil if it doesn't exist yet),
+// returning the action that should be taken. Only created and updated mean the document should be written.
+func decide(policy existingPolicy, doc Document, have map[string]interface{}) (string, error) {
+	if have == nil {
+		return actionCreated, nil
+	}
+
+	want, err := toMap(doc.Body)
+	if err != nil {
+		return "", fmt.Errorf("cannot marshal %v/%v : %v", doc.DB, doc.ID, err)
+	}
+
+	if len(diffDocs(have, want)) == 0 {
+		log.L.Debugf("%v/%v is unchanged", doc.DB, doc.ID)
+		return actionUnchanged, nil
+	}
+
+	switch policy {
+	case skipExisting:
+		log.L.Infof("%v/%v already exists, skipping", doc.DB, doc.ID)
+		return actionSkipped, nil
+	case failExisting:
+		return "", fmt.Errorf("%v/%v already exists", doc.DB, doc.ID)
+	default:
+		return actionUpdated, nil
+	}
+}
+
+// Sink is where the migration writes the new documents to.
+// Sinks may buffer documents; Put and Flush return the results of whatever was actually written.
+type Sink interface {
+	Put(doc Document) []Result
+	Flush() []Result
+}
+
+// fileSink writes one JSON file per document, at <dir>/<db>/<id>.json
+type fileSink struct {
+	dir    string
+	policy existingPolicy
+
+	docs keyedMutex
+}
+
+func (f *fileSink) Put(doc Document) []Result {
+	return []Result{f.put(doc)}
+}
+
+// Flush does nothing, every Put is written immediately.
+func (f *fileSink) Flush() []Result {
+	return nil
+}
+
+func (f *fileSink) put(doc Document) Result {
+	defer f.docs.Lock(doc.DB + "/" + doc.ID)()
+
+	have, err := f.Get(doc.DB, doc.ID)
+	if err != nil {
+		return doc.failed(err)
+	}
+
+	action, err := decide(f.policy, doc, have)
+	if err != nil {
+		return doc.failed(err)
+	}
+	if action != actionCreated && action != actionUpdated {
+		return doc.result(action)
+	}
+
+	body, err := json.MarshalIndent(doc.Body, "", "\t")
+	if err != nil {
+		return doc.failed(fmt.Errorf("cannot marshal %v/%v : %v", doc.DB, doc.ID, err))
+	}
+
+	dir := filepath.Join(f.dir, doc.DB)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return doc.failed(fmt.Errorf("unable to create %v : %v", dir, err))
+	}
+
+	path := filepath.Join(dir, doc.ID+".json")
+	if err := ioutil.WriteFile(path, append(body, '\n'), 0644); err != nil {
+		return doc.failed(fmt.Errorf("unable to write %v : %v", path, err))
+	}
+
+	return doc.result(action)
+}
+
+// getter is implemented by sinks that can read back the documents they hold.
+// Get returns a nil document when id doesn't exist in db.
+type getter interface {
+	Get(db, id string) (map[string]interface{}, error)
+}
+
+func (f *fileSink) Get(db, id string) (map[string]interface{}, error) {
+	path := filepath.Join(f.dir, db, id+".json")
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read %v : %v", path, err)
+	}
+
+	doc := make(map[string]interface{})
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, fmt.Errorf("unable to parse %v : %v", path, err)
+	}
+
+	return doc, nil
+}
+
+// IDs lists every document in db.
+func (f *fileSink) IDs(db string) ([]string, error) {
+	files, err := ioutil.ReadDir(filepath.Join(f.dir, db))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to list %v : %v", db, err)
+	}
+
+	var ids []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), ".json") {
+			ids = append(ids, strings.TrimSuffix(file.Name(), ".json"))
+		}
+	}
+
+	return ids, nil
+}
+
+// toMap converts a document into the generic form it would have after a round trip through JSON.
+func toMap(doc interface{}) (map[string]interface{}, error) {
+	b, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	m := make(map[string]interface{})
+	if err := json.Unmarshal(b, &m); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestDecide(t *testing.T) {
+	doc := Document{DB: "buildings", ID: "ITB", Body: map[string]interface{}{"name": "ITB", "description": "new"}}
+
+	same := map[string]interface{}{"_id": "ITB", "_rev": "1-a", "name": "ITB", "description": "new"}
+	changed := map[string]interface{}{"_id": "ITB", "_rev": "1-a", "name": "ITB", "description": "old"}
+
+	tests := []struct {
+		name   string
+		policy existingPolicy
+		have   map[string]interface{}
+		action string
+		err    bool
+	}{
+		{"new", overwriteExisting, nil, actionCreated, false},
+		{"new, skip", skipExisting, nil, actionCreated, false},
+		{"new, fail", failExisting, nil, actionCreated, false},
+		{"unchanged", overwriteExisting, same, actionUnchanged, false},
+		{"unchanged, fail", failExisting, same, actionUnchanged, false},
+		{"changed", overwriteExisting, changed, actionUpdated, false},
+		{"changed, skip", skipExisting, changed, actionSkipped, false},
+		{"changed, fail", failExisting, changed, "", true},
+	}
+
+	for _, tt := range tests {
+		action, err := decide(tt.policy, doc, tt.have)
+
+		if (err != nil) != tt.err {
+			t.Errorf("%v: decide error = %v, want error %v", tt.name, err, tt.err)
+		}
+		if action != tt.action {
+			t.Errorf("%v: decide = %q, want %q", tt.name, action, tt.action)
+		}
+	}
+}
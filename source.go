@@ -0,0 +1,336 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/av-api/dbo"
+	"github.com/byuoitav/configuration-database-microservice/structs"
+)
+
+// Source is where the migration reads the old configuration database from.
+type Source interface {
+	GetBuildings(ctx context.Context) ([]structs.Building, error)
+	GetRooms(ctx context.Context) ([]structs.Room, error)
+	GetRoomConfigurations(ctx context.Context) ([]structs.RoomConfiguration, error)
+	GetDeviceClasses(ctx context.Context) ([]structs.DeviceClass, error)
+	GetAllRawCommands(ctx context.Context) ([]structs.RawCommand, error)
+	GetPortsByClass(ctx context.Context, class string) ([]structs.DeviceTypePort, error)
+	GetPorts(ctx context.Context) ([]structs.PortType, error)
+	GetMicroservices(ctx context.Context) ([]structs.Microservice, error)
+	GetEndpoints(ctx context.Context) ([]structs.Endpoint, error)
+	GetRoomByInfo(ctx context.Context, building, room string) (structs.Room, error)
+}
+
+// dboSource reads from a live configuration-database-microservice through dbo.
+// dbo can't be cancelled, so each call is given up on (and left to finish in the background)
+// once the context is done or it takes longer than timeout.
+type dboSource struct {
+	timeout time.Duration
+}
+
+func (s dboSource) GetBuildings(ctx context.Context) ([]structs.Building, error) {
+	var v []structs.Building
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetBuildings(); return }); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (s dboSource) GetRooms(ctx context.Context) ([]structs.Room, error) {
+	var v []structs.Room
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetRooms(); return }); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (s dboSource) GetRoomConfigurations(ctx context.Context) ([]structs.RoomConfiguration, error) {
+	var v []structs.RoomConfiguration
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetRoomConfigurations(); return }); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (s dboSource) GetDeviceClasses(ctx context.Context) ([]structs.DeviceClass, error) {
+	var v []structs.DeviceClass
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetDeviceClasses(); return }); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (s dboSource) GetAllRawCommands(ctx context.Context) ([]structs.RawCommand, error) {
+	var v []structs.RawCommand
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetAllRawCommands(); return }); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (s dboSource) GetPortsByClass(ctx context.Context, class string) ([]structs.DeviceTypePort, error) {
+	var v []structs.DeviceTypePort
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetPortsByClass(class); return }); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (s dboSource) GetPorts(ctx context.Context) ([]structs.PortType, error) {
+	var v []structs.PortType
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetPorts(); return }); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (s dboSource) GetMicroservices(ctx context.Context) ([]structs.Microservice, error) {
+	var v []structs.Microservice
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetMicroservices(); return }); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (s dboSource) GetEndpoints(ctx context.Context) ([]structs.Endpoint, error) {
+	var v []structs.Endpoint
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetEndpoints(); return }); err != nil {
+		return nil, err
+	}
+
+	return v, nil
+}
+
+func (s dboSource) GetRoomByInfo(ctx context.Context, building, room string) (structs.Room, error) {
+	var v structs.Room
+	if err := call(ctx, s.timeout, func() (err error) { v, err = dbo.GetRoomByInfo(building, room); return }); err != nil {
+		return structs.Room{}, err
+	}
+
+	return v, nil
+}
+
+// snapshotVersion is the version of the snapshot format written by export-source.
+// Snapshots from before it was versioned are read as version 1.
+const snapshotVersion = 1
+
+// Snapshot is a JSON dump of everything the migration reads from the old configuration database.
+type Snapshot struct {
+	Version     int       `json:"version"`
+	ExportedAt  time.Time `json:"exported_at,omitempty"`
+	ToolVersion string    `json:"tool_version,omitempty"`
+
+	Buildings          []structs.Building                  `json:"buildings"`
+	Rooms              []structs.Room                      `json:"rooms"`
+	RoomConfigurations []structs.RoomConfiguration         `json:"room_configurations"`
+	DeviceClasses      []structs.DeviceClass               `json:"device_classes"`
+	RawCommands        []structs.RawCommand                `json:"raw_commands"`
+	ClassPorts         map[string][]structs.DeviceTypePort `json:"class_ports"`
+	Ports              []structs.PortType                  `json:"ports"`
+	Microservices      []structs.Microservice              `json:"microservices"`
+	Endpoints          []structs.Endpoint                  `json:"endpoints"`
+
+	// FullRooms holds the GetRoomByInfo result for each room, keyed by building shortname and room name (ITB-1101)
+	FullRooms map[string]structs.Room `json:"full_rooms"`
+}
+
+// snapshotSource reads from a Snapshot loaded off of disk.
+type snapshotSource struct {
+	snap Snapshot
+}
+
+// newSnapshotSource loads the snapshot at path, which may be gzipped.
+func newSnapshotSource(path string) (*snapshotSource, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read snapshot %v : %v", path, err)
+	}
+
+	// gzip magic number
+	if bytes.HasPrefix(b, []byte{0x1f, 0x8b}) {
+		r, err := gzip.NewReader(bytes.NewReader(b))
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress snapshot %v : %v", path, err)
+		}
+
+		b, err = ioutil.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress snapshot %v : %v", path, err)
+		}
+	}
+
+	s := &snapshotSource{}
+	if err := json.Unmarshal(b, &s.snap); err != nil {
+		return nil, fmt.Errorf("unable to parse snapshot %v : %v", path, err)
+	}
+
+	// snapshots from before the format was versioned don't have one
+	if s.snap.Version == 0 {
+		s.snap.Version = 1
+	}
+
+	if s.snap.Version < 0 {
+		return nil, fmt.Errorf("snapshot %v has invalid version %v", path, s.snap.Version)
+	}
+	if s.snap.Version > snapshotVersion {
+		return nil, fmt.Errorf("snapshot %v is version %v, this version of the migration only reads up to version %v", path, s.snap.Version, snapshotVersion)
+	}
+
+	return s, nil
+}
+
+// exportSnapshot reads everything the migration uses out of src. Every failure is reported,
+// and the snapshot is only complete if there were none.
+func (r *run) exportSnapshot(ctx context.Context, src Source) *Snapshot {
+	snap := &Snapshot{
+		Version:    snapshotVersion,
+		ExportedAt: time.Now(),
+		ClassPorts: make(map[string][]structs.DeviceTypePort),
+		FullRooms:  make(map[string]structs.Room),
+	}
+
+	var err error
+	check := func(what string, err error) {
+		if err != nil {
+			r.report.Errorf("Failed to get %v from old config db : %v", what, err)
+		}
+	}
+
+	snap.Buildings, err = src.GetBuildings(ctx)
+	check("buildings", err)
+	snap.Rooms, err = src.GetRooms(ctx)
+	check("rooms", err)
+	snap.RoomConfigurations, err = src.GetRoomConfigurations(ctx)
+	check("room configurations", err)
+	snap.DeviceClasses, err = src.GetDeviceClasses(ctx)
+	check("device classes", err)
+	snap.RawCommands, err = src.GetAllRawCommands(ctx)
+	check("raw commands", err)
+	snap.Ports, err = src.GetPorts(ctx)
+	check("ports", err)
+	snap.Microservices, err = src.GetMicroservices(ctx)
+	check("microservices", err)
+	snap.Endpoints, err = src.GetEndpoints(ctx)
+	check("endpoints", err)
+
+	for _, c := range snap.DeviceClasses {
+		snap.ClassPorts[c.Name], err = src.GetPortsByClass(ctx, c.Name)
+		check("ports for class "+c.Name, err)
+	}
+
+	shortnames := make(map[int]string)
+	for _, b := range snap.Buildings {
+		shortnames[b.ID] = b.Shortname
+	}
+
+	var mu sync.Mutex
+	forEach(ctx, r.parallelism, len(snap.Rooms), func(i int) {
+		room := snap.Rooms[i]
+		id := fmt.Sprintf("%s-%s", shortnames[room.Building.ID], room.Name)
+
+		full, err := src.GetRoomByInfo(ctx, shortnames[room.Building.ID], room.Name)
+		check("room "+id, err)
+
+		mu.Lock()
+		snap.FullRooms[id] = full
+		mu.Unlock()
+	})
+
+	return snap
+}
+
+// Save writes the snapshot to path, gzipped if path ends in .gz.
+func (s *Snapshot) Save(path string) error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return fmt.Errorf("cannot marshal snapshot : %v", err)
+	}
+
+	if strings.HasSuffix(path, ".gz") {
+		var buf bytes.Buffer
+
+		w := gzip.NewWriter(&buf)
+		if _, err := w.Write(b); err != nil {
+			return fmt.Errorf("unable to compress snapshot : %v", err)
+		}
+		if err := w.Close(); err != nil {
+			return fmt.Errorf("unable to compress snapshot : %v", err)
+		}
+
+		b = buf.Bytes()
+	}
+
+	// write it somewhere else first, so a failed export never leaves half a snapshot behind
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return fmt.Errorf("unable to write snapshot to %v : %v", path, err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("unable to write snapshot to %v : %v", path, err)
+	}
+
+	return nil
+}
+
+func (s *snapshotSource) GetBuildings(ctx context.Context) ([]structs.Building, error) {
+	return s.snap.Buildings, nil
+}
+
+func (s *snapshotSource) GetRooms(ctx context.Context) ([]structs.Room, error) {
+	return s.snap.Rooms, nil
+}
+
+func (s *snapshotSource) GetRoomConfigurations(ctx context.Context) ([]structs.RoomConfiguration, error) {
+	return s.snap.RoomConfigurations, nil
+}
+
+func (s *snapshotSource) GetDeviceClasses(ctx context.Context) ([]structs.DeviceClass, error) {
+	return s.snap.DeviceClasses, nil
+}
+
+func (s *snapshotSource) GetAllRawCommands(ctx context.Context) ([]structs.RawCommand, error) {
+	return s.snap.RawCommands, nil
+}
+
+func (s *snapshotSource) GetPortsByClass(ctx context.Context, class string) ([]structs.DeviceTypePort, error) {
+	return s.snap.ClassPorts[class], nil
+}
+
+func (s *snapshotSource) GetPorts(ctx context.Context) ([]structs.PortType, error) {
+	return s.snap.Ports, nil
+}
+
+func (s *snapshotSource) GetMicroservices(ctx context.Context) ([]structs.Microservice, error) {
+	return s.snap.Microservices, nil
+}
+
+func (s *snapshotSource) GetEndpoints(ctx context.Context) ([]structs.Endpoint, error) {
+	return s.snap.Endpoints, nil
+}
+
+func (s *snapshotSource) GetRoomByInfo(ctx context.Context, building, room string) (structs.Room, error) {
+	r, ok := s.snap.FullRooms[fmt.Sprintf("%s-%s", building, room)]
+	if !ok {
+		return structs.Room{}, fmt.Errorf("room %s-%s is not in the snapshot", building, room)
+	}
+
+	return r, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/byuoitav/configuration-database-microservice/structs"
+)
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	itb := structs.Building{ID: 1, Name: "Information Technology Building", Shortname: "ITB"}
+	room := structs.Room{ID: 1, Name: "1101", Building: itb, ConfigurationID: 1, RoomDesignation: "production"}
+	full := room
+	full.Devices = []structs.Device{{ID: 1, Name: "D1", Address: "ITB-1101-D1.byu.edu"}}
+
+	// an old database to export from
+	old := &snapshotSource{snap: Snapshot{
+		Buildings:          []structs.Building{itb},
+		Rooms:              []structs.Room{room},
+		RoomConfigurations: []structs.RoomConfiguration{{ID: 1, Name: "Default"}},
+		DeviceClasses:      []structs.DeviceClass{{Name: "TV"}},
+		ClassPorts:         map[string][]structs.DeviceTypePort{"TV": nil},
+		FullRooms:          map[string]structs.Room{"ITB-1101": full},
+	}}
+
+	r := &run{report: newReport(), parallelism: 1}
+	exported := r.exportSnapshot(context.Background(), old)
+	if r.report.Failed() {
+		t.Fatalf("export failed : %v", r.report.Errors)
+	}
+
+	for _, name := range []string{"snapshot.json", "snapshot.json.gz"} {
+		path := filepath.Join(dir, name)
+		if err := exported.Save(path); err != nil {
+			t.Fatalf("%v: Save : %v", name, err)
+		}
+
+		s, err := newSnapshotSource(path)
+		if err != nil {
+			t.Fatalf("%v: newSnapshotSource : %v", name, err)
+		}
+
+		if !s.snap.ExportedAt.Equal(exported.ExportedAt) {
+			t.Errorf("%v: exported at %v, want %v", name, s.snap.ExportedAt, exported.ExportedAt)
+		}
+
+		loaded := s.snap
+		want := *exported
+		loaded.ExportedAt = want.ExportedAt
+
+		if !reflect.DeepEqual(loaded, want) {
+			t.Errorf("%v: loaded %+v, want %+v", name, loaded, want)
+		}
+
+		got, err := s.GetRoomByInfo(context.Background(), "ITB", "1101")
+		if err != nil || !reflect.DeepEqual(got, full) {
+			t.Errorf("%v: GetRoomByInfo = %+v, %v, want %+v", name, got, err, full)
+		}
+	}
+}
+
+func TestSnapshotVersion(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		json    string
+		version int
+		err     string
+	}{
+		{"unversioned", `{"buildings": []}`, 1, ""},
+		{"zero", `{"version": 0}`, 1, ""},
+		{"current", `{"version": 1}`, 1, ""},
+		{"newer", `{"version": 2}`, 0, "only reads up to version 1"},
+		{"negative", `{"version": -1}`, 0, "invalid version"},
+	}
+
+	for _, tt := range tests {
+		path := filepath.Join(dir, tt.name+".json")
+		if err := ioutil.WriteFile(path, []byte(tt.json), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := newSnapshotSource(path)
+		switch {
+		case len(tt.err) > 0:
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%v: error = %v, want it to mention %q", tt.name, err, tt.err)
+			}
+		case err != nil:
+			t.Errorf("%v: newSnapshotSource : %v", tt.name, err)
+		case s.snap.Version != tt.version:
+			t.Errorf("%v: version = %v, want %v", tt.name, s.snap.Version, tt.version)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/byuoitav/common/log"
+)
+
+// transportSettings tune the connections made to couch.
+type transportSettings struct {
+	maxConnsPerHost int
+	gzip            bool // compress request bodies
+
+	caFile   string // PEM bundle of CAs to trust, on top of the system ones
+	certFile string // client certificate and key, for couch instances that require one
+	keyFile  string
+	insecure bool // don't verify couch's certificate, for lab instances only
+}
+
+// defaultTransport is what the couch client is built with unless it is changed with flags
+var defaultTransport = transportSettings{
+	maxConnsPerHost: 16,
+}
+
+var (
+	clientOnce   sync.Once
+	sharedClient *http.Client
+)
+
+// couchClient returns the client every couch sink shares, so connections are kept alive and reused
+// across documents, phases and sinks. It is built from s the first time it is called.
+func couchClient(s transportSettings) *http.Client {
+	clientOnce.Do(func() {
+		t, err := newTransport(s)
+		if err != nil {
+			log.L.Fatalf("Invalid transport settings : %v", err)
+		}
+
+		sharedClient = &http.Client{Transport: t}
+	})
+
+	return sharedClient
+}
+
+func newTransport(s transportSettings) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: s.insecure,
+	}
+
+	if s.insecure {
+		log.L.Warnf("Not verifying the target's TLS certificate")
+	}
+
+	if len(s.caFile) > 0 {
+		pem, err := ioutil.ReadFile(s.caFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle : %v", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %v", s.caFile)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	if len(s.certFile) > 0 || len(s.keyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate : %v", err)
+		}
+
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	return &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   10 * time.Second,
+		MaxIdleConns:          s.maxConnsPerHost,
+		MaxIdleConnsPerHost:   s.maxConnsPerHost,
+		MaxConnsPerHost:       s.maxConnsPerHost,
+		IdleConnTimeout:       90 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}, nil
+}
+
+// gzipBody compresses a request body.
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(body); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
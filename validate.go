@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/byuoitav/common/log"
+	newstructs "github.com/byuoitav/common/structs"
+)
+
+// what happens when the generated documents reference something that doesn't exist
+const (
+	validateOff   = "off"
+	validateWarn  = "warn"
+	validateBlock = "block"
+)
+
+// collectSink holds on to every document instead of writing it, so the whole set can be
+// checked before anything is written.
+type collectSink struct {
+	mu    sync.Mutex
+	order map[string][]string
+	docs  map[string]map[string]Document
+}
+
+func newCollectSink() *collectSink {
+	return &collectSink{
+		order: make(map[string][]string),
+		docs:  make(map[string]map[string]Document),
+	}
+}
+
+// Put keeps doc, replacing any earlier document with the same id.
+func (c *collectSink) Put(doc Document) []Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.docs[doc.DB]; !ok {
+		c.docs[doc.DB] = make(map[string]Document)
+	}
+
+	if _, ok := c.docs[doc.DB][doc.ID]; !ok {
+		c.order[doc.DB] = append(c.order[doc.DB], doc.ID)
+	}
+
+	c.docs[doc.DB][doc.ID] = doc
+	return nil
+}
+
+// Flush does nothing, documents are only written by replay.
+func (c *collectSink) Flush() []Result {
+	return nil
+}
+
+func (c *collectSink) has(db, id string) bool {
+	_, ok := c.docs[db][id]
+	return ok
+}
+
+// Documents returns the documents collected for db, in the order they were first put.
+func (c *collectSink) Documents(db string) []Document {
+	docs := make([]Document, len(c.order[db]))
+	for i, id := range c.order[db] {
+		docs[i] = c.docs[db][id]
+	}
+
+	return docs
+}
+
+// replay writes everything c collected for phases, in phase order.
+func (r *run) replay(ctx context.Context, c *collectSink, phases []string) {
+	for _, phase := range phases {
+		r.checkpoint.StartPhase(phase)
+
+		for _, db := range r.phaseWrites(phase) {
+			docs := c.Documents(db)
+			forEach(ctx, r.parallelism, len(docs), func(i int) {
+				r.put(docs[i])
+			})
+		}
+
+		r.flush()
+
+		if ctx.Err() != nil {
+			r.checkpoint.save()
+			if err := r.manifest.Save(); err != nil {
+				log.L.Errorf("%v", err)
+			}
+
+			return
+		}
+
+		r.checkpoint.FinishPhase(phase)
+
+		if err := r.manifest.Save(); err != nil {
+			log.L.Errorf("%v", err)
+		}
+	}
+}
+
+// validateReferences checks every reference between the collected documents: rooms to
+// their configuration, devices to their type and to the devices on either end of their ports,
+// and device type commands to their microservice and endpoint. A reference to a document that
+// wasn't generated in this run is fine as long as it already exists in target.
+func validateReferences(c *collectSink, target getter, dbs databases) []string {
+	var problems []string
+
+	// what has already been looked up in target
+	found := make(map[string]bool)
+
+	exists := func(db, id string) bool {
+		if len(id) == 0 {
+			return false
+		}
+		if c.has(db, id) {
+			return true
+		}
+
+		if ok, checked := found[db+"/"+id]; checked {
+			return ok
+		}
+
+		doc, err := target.Get(db, id)
+		if err != nil {
+			log.L.Warnf("Unable to check for %v/%v : %v", db, id, err)
+		}
+
+		found[db+"/"+id] = doc != nil
+		return doc != nil
+	}
+
+	for _, doc := range c.Documents(dbs.rooms) {
+		room, ok := doc.Body.(newstructs.Room)
+		if !ok {
+			continue
+		}
+
+		if !exists(dbs.roomConfigurations, room.Configuration.ID) {
+			problems = append(problems, fmt.Sprintf("room %v references room configuration %q, which doesn't exist", room.ID, room.Configuration.ID))
+		}
+	}
+
+	for _, doc := range c.Documents(dbs.devices) {
+		device, ok := doc.Body.(newstructs.Device)
+		if !ok {
+			continue
+		}
+
+		if !exists(dbs.deviceTypes, device.Type.ID) {
+			problems = append(problems, fmt.Sprintf("device %v references device type %q, which doesn't exist", device.ID, device.Type.ID))
+		}
+
+		for _, port := range device.Ports {
+			if !exists(dbs.devices, port.SourceDevice) {
+				problems = append(problems, fmt.Sprintf("port %v on device %v has source device %q, which doesn't exist", port.ID, device.ID, port.SourceDevice))
+			}
+			if !exists(dbs.devices, port.DestinationDevice) {
+				problems = append(problems, fmt.Sprintf("port %v on device %v has destination device %q, which doesn't exist", port.ID, device.ID, port.DestinationDevice))
+			}
+		}
+	}
+
+	for _, doc := range c.Documents(dbs.deviceTypes) {
+		dt, ok := doc.Body.(newstructs.DeviceType)
+		if !ok {
+			continue
+		}
+
+		for _, command := range dt.Commands {
+			if len(command.Microservice.ID) == 0 {
+				problems = append(problems, fmt.Sprintf("command %v on device type %v has no matching microservice", command.ID, dt.ID))
+			}
+			if len(command.Endpoint.ID) == 0 {
+				problems = append(problems, fmt.Sprintf("command %v on device type %v has no matching endpoint", command.ID, dt.ID))
+			}
+		}
+	}
+
+	return problems
+}
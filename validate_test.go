@@ -0,0 +1,56 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	newstructs "github.com/byuoitav/common/structs"
+)
+
+func TestValidateReferences(t *testing.T) {
+	dbs := defaultDatabases
+
+	room := func(id, config string) Document {
+		return Document{DB: dbs.rooms, ID: id, Body: newstructs.Room{ID: id, Configuration: newstructs.RoomConfiguration{ID: config}}}
+	}
+	config := func(id string) Document {
+		return Document{DB: dbs.roomConfigurations, ID: id, Body: newstructs.RoomConfiguration{ID: id}}
+	}
+	device := func(id, typ string) Document {
+		return Document{DB: dbs.devices, ID: id, Body: newstructs.Device{ID: id, Type: newstructs.DeviceType{ID: typ}}}
+	}
+	deviceType := func(id, microservice, endpoint string) Document {
+		command := newstructs.Command{ID: "PowerOn", Microservice: newstructs.Microservice{ID: microservice}, Endpoint: newstructs.Endpoint{ID: endpoint}}
+		return Document{DB: dbs.deviceTypes, ID: id, Body: newstructs.DeviceType{ID: id, Commands: []newstructs.Command{command}}}
+	}
+
+	// already written by an earlier run
+	target := mapGetter{
+		dbs.roomConfigurations + "/Tiered": {"_id": "Tiered"},
+		dbs.deviceTypes + "/SonyXBR":       {"_id": "SonyXBR"},
+	}
+
+	tests := []struct {
+		name string
+		docs []Document
+		want []string
+	}{
+		{"complete", []Document{config("Default"), room("ITB-1101", "Default"), deviceType("Projector", "sony", "power"), device("ITB-1101-D1", "Projector")}, nil},
+		{"in target", []Document{room("ITB-1101", "Tiered"), device("ITB-1101-D1", "SonyXBR")}, nil},
+		{"missing room configuration", []Document{room("ITB-1101", "Default")}, []string{`room ITB-1101 references room configuration "Default", which doesn't exist`}},
+		{"missing device type", []Document{device("ITB-1101-D1", "Projector")}, []string{`device ITB-1101-D1 references device type "Projector", which doesn't exist`}},
+		{"missing microservice", []Document{deviceType("Projector", "", "power")}, []string{"command PowerOn on device type Projector has no matching microservice"}},
+		{"missing endpoint", []Document{deviceType("Projector", "sony", "")}, []string{"command PowerOn on device type Projector has no matching endpoint"}},
+	}
+
+	for _, tt := range tests {
+		c := newCollectSink()
+		for _, doc := range tt.docs {
+			c.Put(doc)
+		}
+
+		if got := validateReferences(c, target, dbs); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: problems = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/byuoitav/common/log"
+)
+
+// the outcomes of verifying a document
+const (
+	actionMatched    = "matched"
+	actionMissing    = "missing"
+	actionMismatched = "mismatched"
+	actionExtra      = "extra"
+)
+
+// lister is implemented by sinks that can list the documents they hold.
+type lister interface {
+	IDs(db string) ([]string, error)
+}
+
+// verifySink compares every document the migration generates against what is in the target.
+// Documents are compared once per phase, when the sink is flushed, so a document generated
+// more than once is checked the way the last write would have left it.
+type verifySink struct {
+	target      getter
+	report      *Report
+	parallelism int
+
+	mu       sync.Mutex
+	pending  map[string]Document
+	expected map[string]map[string]bool
+}
+
+func newVerifySink(target getter, parallelism int, report *Report) *verifySink {
+	return &verifySink{
+		target:      target,
+		report:      report,
+		parallelism: parallelism,
+		pending:     make(map[string]Document),
+		expected:    make(map[string]map[string]bool),
+	}
+}
+
+func (v *verifySink) Put(doc Document) []Result {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.pending[doc.DB+"/"+doc.ID] = doc
+
+	if _, ok := v.expected[doc.DB]; !ok {
+		v.expected[doc.DB] = make(map[string]bool)
+	}
+	v.expected[doc.DB][doc.ID] = true
+
+	return nil
+}
+
+// Flush compares everything generated since the last flush.
+func (v *verifySink) Flush() []Result {
+	v.mu.Lock()
+	docs := make([]Document, 0, len(v.pending))
+	for _, doc := range v.pending {
+		docs = append(docs, doc)
+	}
+	v.pending = make(map[string]Document)
+	v.mu.Unlock()
+
+	results := make([]Result, len(docs))
+	forEach(context.Background(), v.parallelism, len(docs), func(i int) {
+		results[i] = v.verify(docs[i])
+	})
+
+	return results
+}
+
+func (v *verifySink) verify(doc Document) Result {
+	want, err := toMap(doc.Body)
+	if err != nil {
+		return doc.failed(fmt.Errorf("cannot marshal %v/%v : %v", doc.DB, doc.ID, err))
+	}
+
+	have, err := v.target.Get(doc.DB, doc.ID)
+	if err != nil {
+		return doc.failed(err)
+	}
+
+	if have == nil {
+		return doc.result(actionMissing)
+	}
+
+	changes := diffDocs(have, want)
+	if len(changes) > 0 {
+		res := doc.result(actionMismatched)
+		res.Reason = strings.Join(changes, "; ")
+		return res
+	}
+
+	return doc.result(actionMatched)
+}
+
+// Extras returns a result for every document in the target databases that the migration didn't generate.
+func (v *verifySink) Extras(dbs []string) []Result {
+	l, ok := v.target.(lister)
+	if !ok {
+		return nil
+	}
+
+	var results []Result
+
+	for _, db := range dbs {
+		ids, err := l.IDs(db)
+		if err != nil {
+			v.report.Errorf("Failed to list %v : %v", db, err)
+			continue
+		}
+
+		sort.Strings(ids)
+		for _, id := range ids {
+			if !v.expected[db][id] {
+				results = append(results, Result{DB: db, ID: id, Action: actionExtra})
+			}
+		}
+	}
+
+	return results
+}
+
+// runVerify regenerates every document from the old configuration database and checks that
+// it is in the target, reporting documents that are missing, different or extra.
+func runVerify(o *options) {
+	r, phases := setup(o)
+
+	ctx, cancel := runContext(o.deadline)
+	defer cancel()
+
+	var target getter = &fileSink{dir: o.outputDir}
+	if len(o.outputDir) == 0 {
+		target = newCouchSink(ctx, o, overwriteExisting)
+	}
+
+	v := newVerifySink(target, r.parallelism, r.report)
+	r.sink = v
+
+	r.loadSource(ctx, o, phases)
+	r.runPhases(ctx, phases)
+
+	if r.stopped(ctx) {
+		r.finish(o.reportPath)
+		return
+	}
+
+	// extra documents only mean something when every room was verified
+	if r.selected.filtered() {
+		log.L.Infof("Not checking for extra documents, only part of the old database was verified")
+	} else {
+		var dbs []string
+		for _, phase := range phases {
+			for _, db := range r.phaseWrites(phase) {
+				if r.selected.writes(db) {
+					dbs = append(dbs, db)
+				}
+			}
+		}
+
+		r.report.Add(v.Extras(dbs)...)
+	}
+
+	r.finish(o.reportPath)
+}
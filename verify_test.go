@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestVerify(t *testing.T) {
+	target := mapGetter{
+		"rooms/ITB-1101": {"_id": "ITB-1101", "_rev": "1-a", "name": "ITB-1101", "designation": "production"},
+		"rooms/ITB-1102": {"_id": "ITB-1102", "_rev": "1-a", "name": "ITB-1102", "designation": "stage"},
+	}
+
+	tests := []struct {
+		doc    Document
+		action string
+		reason string
+	}{
+		{Document{DB: "rooms", ID: "ITB-1101", Body: map[string]interface{}{"name": "ITB-1101", "designation": "production"}}, actionMatched, ""},
+		{Document{DB: "rooms", ID: "ITB-1102", Body: map[string]interface{}{"name": "ITB-1102", "designation": "production"}}, actionMismatched, "designation"},
+		{Document{DB: "rooms", ID: "ITB-1103", Body: map[string]interface{}{"name": "ITB-1103"}}, actionMissing, ""},
+	}
+
+	for _, tt := range tests {
+		v := newVerifySink(target, 1, newReport())
+		v.Put(tt.doc)
+
+		results := v.Flush()
+		if len(results) != 1 || results[0].Action != tt.action {
+			t.Errorf("%v: verify = %+v, want %v", tt.doc.ID, results, tt.action)
+			continue
+		}
+
+		if !strings.Contains(results[0].Reason, tt.reason) {
+			t.Errorf("%v: verify reason %q, want it to mention %q", tt.doc.ID, results[0].Reason, tt.reason)
+		}
+	}
+}